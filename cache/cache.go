@@ -1,194 +1,485 @@
 package cache
 
 import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultShards is the amount of shards used by New.
+const DefaultShards = 64
+
+// accessResolution limits how often the access time of an entry is updated,
+// this avoids concurrent readers of a hot entry contending on its cache line.
+const accessResolution = int64(time.Millisecond)
+
 type Tag string
 type Key string
 
+// ErrVersion is returned by CompareAndSet when the version does not match.
+var ErrVersion = errors.New("Version mismatch")
+
+// Item is a copy of a cache entry.
+type Item struct {
+	Value   string
+	Tags    []Tag
+	Expires time.Time
+	// Version increases with every write to any key and is never reused,
+	// not even across restarts.
+	Version uint64
+	// Flags is opaque client data, e.g. memcached item flags.
+	Flags uint32
+	// Meta is opaque client data as name value pairs, e.g. http headers.
+	Meta map[string]string
+	// Modified is the time of the write that stored this version, it is
+	// ignored when storing an Item.
+	Modified time.Time
+}
+
 type Cache struct {
-	dsem sync.RWMutex
-	tsem sync.RWMutex
-	data map[Key]*entry
+	// version is the last version handed out to an entry, it starts at
+	// the creation time in unix nanoseconds so a restarted process does not
+	// hand out versions of entries that were lost or deleted again.
+	version uint64
+	// stats is kept near the top for 64 bit alignment of its counters.
+	stats Stats
+
+	shards  []*shard
+	tshards []*tagShard
+
+	policy atomic.Value // policyBox
+	qsem   sync.Mutex
+	quotas atomic.Value // map[string]Quota
+
+	j  *Journal
+	ev *bus
+}
+
+type policyBox struct{ p Policy }
+
+// shard holds a subset of all entries, chosen by key hash.
+type shard struct {
+	sem     sync.RWMutex
+	data    map[Key]*entry
+	exp     expiry
+	usage   Usage
+	nsUsage map[string]*Usage
+	// nsKeys indexes the entries by namespace so quota eviction only has
+	// to consider the namespace itself.
+	nsKeys map[string]map[Key]*entry
+}
+
+// tagShard holds a subset of all tags, chosen by tag hash.
+type tagShard struct {
+	sem  sync.RWMutex
 	tags map[Tag]*tags
 }
 
 func New() *Cache {
-	var dsem sync.RWMutex
-	var tsem sync.RWMutex
-	return &Cache{
-		dsem,
-		tsem,
-		make(map[Key]*entry, 100),
-		make(map[Tag]*tags),
-	}
-}
-
-// https://github.com/golang/go/issues/20135
-// func (c *Cache) Recreate() {
-// 	d := make(map[Key]*entry, c.Len())
-// 	c.dsem.RLock()
-// 	for i := range c.data {
-// 		d[i] = c.data[i]
-// 	}
-// 	c.dsem.RUnlock()
-//
-// 	c.dsem.Lock()
-// 	c.data = d
-// 	c.dsem.Unlock()
-//
-// 	t := make(map[Tag]*tags, c.TagsLen())
-// 	c.tsem.RLock()
-// 	for i := range c.tags {
-// 		t[i] = c.tags[i]
-// 	}
-// 	c.tsem.RUnlock()
-//
-// 	c.tsem.Lock()
-// 	c.tags = t
-// 	c.tsem.Unlock()
-// }
+	return NewShards(DefaultShards)
+}
+
+// NewShards creates a cache whose data and tags are split in n
+// independently locked shards.
+func NewShards(n int) *Cache {
+	if n < 1 {
+		n = 1
+	}
+
+	c := &Cache{
+		version: uint64(time.Now().UnixNano()),
+		shards:  make([]*shard, n),
+		tshards: make([]*tagShard, n),
+		ev:      newBus(),
+	}
+
+	for i := range c.shards {
+		c.shards[i] = newShard()
+		c.tshards[i] = &tagShard{tags: make(map[Tag]*tags)}
+	}
+
+	c.policy.Store(policyBox{LRU})
+	c.quotas.Store(map[string]Quota{})
+	return c
+}
+
+func newShard() *shard {
+	return &shard{
+		data:    make(map[Key]*entry, 100),
+		nsUsage: make(map[string]*Usage),
+		nsKeys:  make(map[string]map[Key]*entry),
+	}
+}
+
+// SetPolicy changes the eviction policy used by Evict, defaults to LRU.
+func (c *Cache) SetPolicy(p Policy) {
+	c.policy.Store(policyBox{p})
+}
+
+func (c *Cache) getPolicy() Policy {
+	return c.policy.Load().(policyBox).p
+}
 
 func (c *Cache) Len() int {
-	c.dsem.RLock()
-	l := len(c.data)
-	c.dsem.RUnlock()
+	l := 0
+	for _, s := range c.shards {
+		s.sem.RLock()
+		l += len(s.data)
+		s.sem.RUnlock()
+	}
 	return l
 }
 
 func (c *Cache) TagsLen() int {
-	c.tsem.RLock()
-	l := len(c.tags)
-	c.tsem.RUnlock()
+	l := 0
+	for _, s := range c.tshards {
+		s.sem.RLock()
+		l += len(s.tags)
+		s.sem.RUnlock()
+	}
 	return l
 }
 
-func (c *Cache) Set(key Key, tags []Tag, value string, expires time.Time) {
-	c.dsem.Lock()
-	c.data[key] = &entry{value, expires}
-	c.dsem.Unlock()
+// Set stores a value, it returns ErrQuota if the namespace quota of key
+// does not allow it.
+func (c *Cache) Set(key Key, tags []Tag, value string, expires time.Time) error {
+	_, err := c.set(c.newEntry(key, tags, value, expires, 0), nil)
+	return err
+}
+
+// CompareAndSet stores a value only if the current version of key equals
+// version, where 0 means the key should not exist. It returns the new
+// version or ErrVersion if the key was modified in the meantime.
+func (c *Cache) CompareAndSet(
+	key Key,
+	tags []Tag,
+	value string,
+	expires time.Time,
+	version uint64,
+) (uint64, error) {
+	return c.set(c.newEntry(key, tags, value, expires, 0), &version)
+}
+
+// SetItem stores item at key and returns its new version,
+// item.Version is ignored.
+func (c *Cache) SetItem(key Key, item Item) (uint64, error) {
+	return c.set(c.itemEntry(key, item), nil)
+}
+
+// CompareAndSetItem is CompareAndSet for an Item, item.Version is ignored.
+func (c *Cache) CompareAndSetItem(key Key, item Item, version uint64) (uint64, error) {
+	return c.set(c.itemEntry(key, item), &version)
+}
+
+// Touch changes the expiry of key, it returns false if key does not exist.
+func (c *Cache) Touch(key Key, expires time.Time) (bool, error) {
+	for {
+		item, ok := c.getItem(key)
+		if !ok {
+			return false, nil
+		}
+
+		version := item.Version
+		item.Expires = expires
+		_, err := c.set(c.itemEntry(key, item), &version)
+		if err != ErrVersion {
+			return err == nil, err
+		}
+	}
+}
+
+func (c *Cache) itemEntry(key Key, item Item) *entry {
+	e := c.newEntry(key, item.Tags, item.Value, item.Expires, 0)
+	e.f = item.Flags
+	e.m = copyMeta(item.Meta)
+	return e
+}
+
+func (c *Cache) newEntry(
+	key Key,
+	tags []Tag,
+	value string,
+	expires time.Time,
+	version uint64,
+) *entry {
+	now := time.Now()
+	e := &entry{a: now.UnixNano(), k: key, d: value, e: expires, w: now}
+	if len(tags) != 0 {
+		e.t = make([]Tag, len(tags))
+		copy(e.t, tags)
+	}
+
+	e.v = version
+	if version == 0 {
+		e.v = atomic.AddUint64(&c.version, 1)
+		return e
+	}
 
-	for _, t := range tags {
-		c.tsem.RLock()
-		keys := c.tags[t]
-		c.tsem.RUnlock()
-		if keys == nil {
-			c.tsem.Lock()
-			c.tags[t] = newTags()
-			c.tsem.Unlock()
+	// Restoring a persisted entry, make sure new versions are higher.
+	for {
+		cur := atomic.LoadUint64(&c.version)
+		if cur >= version || atomic.CompareAndSwapUint64(&c.version, cur, version) {
+			return e
 		}
-		c.tags[t].add(key)
 	}
 }
 
+// set stores e if the current version of its key equals expect
+// or unconditionally if expect is nil.
+func (c *Cache) set(e *entry, expect *uint64) (uint64, error) {
+	if err := c.reserve(e.k, e); err != nil {
+		return 0, err
+	}
+
+	s := c.shard(e.k)
+	s.sem.Lock()
+	if expect != nil && s.version(e.k, time.Now()) != *expect {
+		s.sem.Unlock()
+		return 0, ErrVersion
+	}
+	s.del(e.k)
+	s.data[e.k] = e
+	heap.Push(&s.exp, e)
+	s.account(e.k, e, true)
+	c.j.set(e)
+	c.ev.emit(ReasonSet, e)
+	s.sem.Unlock()
+
+	for _, t := range e.t {
+		c.tagSet(t, true).add(e.k)
+	}
+
+	return e.v, nil
+}
+
 func (c *Cache) Get(key Key) (string, bool) {
-	c.dsem.RLock()
-	d := c.data[key]
-	c.dsem.RUnlock()
+	s := c.shard(key)
+	s.sem.RLock()
+	d := s.data[key]
+	s.sem.RUnlock()
 
 	if d == nil {
+		c.lookup(false)
 		return "", false
 	}
 
-	if d.e.Before(time.Now()) {
+	now := time.Now()
+	if d.e.Before(now) {
+		c.lookup(false)
 		return "", false
 	}
 
+	d.touch(now.UnixNano())
+	c.lookup(true)
 	return d.d, true
 }
 
+// GetItem returns a copy of the entry stored at key.
+func (c *Cache) GetItem(key Key) (Item, bool) {
+	item, ok := c.getItem(key)
+	c.lookup(ok)
+	return item, ok
+}
+
+// getItem is GetItem without counting a hit or miss, for read-modify-write
+// operations.
+func (c *Cache) getItem(key Key) (Item, bool) {
+	s := c.shard(key)
+	s.sem.RLock()
+	d := s.data[key]
+	s.sem.RUnlock()
+
+	now := time.Now()
+	if d == nil || d.e.Before(now) {
+		return Item{}, false
+	}
+
+	d.touch(now.UnixNano())
+	return d.item(), true
+}
+
 func (c *Cache) GetTagKeys(tag Tag) []Key {
-	c.tsem.RLock()
-	t := c.tags[tag]
-	c.tsem.RUnlock()
+	t := c.tagSet(tag, false)
 	if t == nil {
 		return nil
 	}
 
 	return t.get()
-
 }
 
 func (c *Cache) IterateKeys(cb func(Key) bool) {
-	c.dsem.RLock()
-	for i := range c.data {
-		if !cb(i) {
+	for _, s := range c.shards {
+		s.sem.RLock()
+		for i := range s.data {
+			if !cb(i) {
+				s.sem.RUnlock()
+				return
+			}
+		}
+		s.sem.RUnlock()
+	}
+}
+
+// Shards returns the amount of shards the cache is split in.
+func (c *Cache) Shards() int {
+	return len(c.shards)
+}
+
+// IterateShardKeys calls cb for every key of namespace ns in shard i,
+// which allows iterating a namespace one shard at a time.
+func (c *Cache) IterateShardKeys(i int, ns string, cb func(Key) bool) {
+	s := c.shards[i]
+	s.sem.RLock()
+	for k := range s.nsKeys[ns] {
+		if !cb(k) {
 			break
 		}
 	}
-	c.dsem.RUnlock()
+	s.sem.RUnlock()
 }
 
 func (c *Cache) IterateTags(cb func(Tag) bool) {
-	c.tsem.RLock()
-	for i := range c.tags {
-		if !cb(i) {
-			break
+	for _, s := range c.tshards {
+		s.sem.RLock()
+		for i := range s.tags {
+			if !cb(i) {
+				s.sem.RUnlock()
+				return
+			}
 		}
+		s.sem.RUnlock()
 	}
-	c.tsem.RUnlock()
 }
 
-func (c *Cache) Del(key Key) {
-	c.dsem.Lock()
-	c.del(key)
-	c.dsem.Unlock()
+// Del removes key and reports whether it existed.
+func (c *Cache) Del(key Key) bool {
+	return c.del(key, ReasonDel).Keys != 0
 }
 
 func (c *Cache) DelByTag(tag Tag) {
-	c.tsem.Lock()
-	t := c.tags[tag]
-	delete(c.tags, tag)
-	c.tsem.Unlock()
+	s := c.tagShard(tag)
+	s.sem.Lock()
+	t := s.tags[tag]
+	delete(s.tags, tag)
+	s.sem.Unlock()
 	if t == nil {
 		return
 	}
 
-	t.delFromCache(c)
+	atomic.AddUint64(&c.stats.TagDeleted, uint64(t.delFromCache(c)))
 }
 
+// DelByPrefix removes all keys starting with prefix, one shard at a time.
+// The removed keys of a shard are journaled while it is locked so the
+// journal never orders them differently from concurrent writes.
 func (c *Cache) DelByPrefix(prefix Key) {
-	c.dsem.Lock()
-	for i := range c.data {
-		if len(i) >= len(prefix) && i[0:len(prefix)] == prefix {
-			c.del(i)
-		}
+	// A namespace prefix only has to look at the keys of that namespace.
+	ns, isNS := "", false
+	if i := strings.Index(string(prefix), NSSep); i != -1 && i == len(prefix)-len(NSSep) {
+		ns, isNS = string(prefix[:i]), true
 	}
-	c.dsem.Unlock()
-}
 
-func (c *Cache) DelExpired() {
-	c.delExpired(c.Len() / 100)
+	n := 0
+	var keys []Key
+	for _, s := range c.shards {
+		s.sem.Lock()
+		candidates := s.data
+		if isNS {
+			candidates = s.nsKeys[ns]
+		}
+
+		keys = keys[:0]
+		for k, e := range candidates {
+			if strings.HasPrefix(string(k), string(prefix)) {
+				c.ev.emit(ReasonPurge, e)
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range keys {
+			s.del(k)
+		}
+		c.j.delKeys(keys)
+		s.sem.Unlock()
+		n += len(keys)
+	}
+	atomic.AddUint64(&c.stats.Purged, uint64(n))
 }
 
-func (c *Cache) DelRand(n int) {
+// Evict removes n entries chosen by the configured Policy.
+func (c *Cache) Evict(n int) {
 	if n <= 0 {
 		return
 	}
 
-	c.dsem.Lock()
-	for i := range c.data {
-		c.del(i)
-		if n--; n <= 0 {
+	for _, k := range c.victims(c.getPolicy(), n, nil, "") {
+		atomic.AddUint64(&c.stats.Evicted, uint64(c.del(k, ReasonEvicted).Keys))
+	}
+}
+
+// EvictBytes removes entries chosen by the configured Policy until at least
+// n bytes are freed or the cache is empty and returns the amount freed.
+func (c *Cache) EvictBytes(n uint64) uint64 {
+	var freed uint64
+	p := c.getPolicy()
+	for freed < n {
+		u := c.Usage()
+		if u.Keys <= 0 {
+			break
+		}
+
+		// Estimate the amount of entries we need based on the average size.
+		avg := u.Bytes() / uint64(u.Keys)
+		batch := int((n-freed)/(avg+1)) + 1
+		victims := c.victims(p, batch, nil, "")
+		if len(victims) == 0 {
 			break
 		}
+
+		for _, k := range victims {
+			u := c.del(k, ReasonEvicted)
+			freed += u.Bytes()
+			atomic.AddUint64(&c.stats.Evicted, uint64(u.Keys))
+			if freed >= n {
+				break
+			}
+		}
 	}
 
-	c.dsem.Unlock()
+	return freed
 }
 
 func (c *Cache) DelAll() {
-	data := make(map[Key]*entry)
-	tags := make(map[Tag]*tags)
+	for _, s := range c.shards {
+		s.sem.Lock()
+	}
 
-	c.dsem.Lock()
-	c.tsem.Lock()
-	c.data = data
-	c.tags = tags
-	c.dsem.Unlock()
-	c.tsem.Unlock()
+	c.j.delAll()
+	for _, s := range c.shards {
+		atomic.AddUint64(&c.stats.Purged, uint64(len(s.data)))
+		if c.ev.active() {
+			for _, e := range s.data {
+				c.ev.emit(ReasonPurge, e)
+			}
+		}
+		n := newShard()
+		s.data = n.data
+		s.exp = n.exp
+		s.usage = n.usage
+		s.nsUsage = n.nsUsage
+		s.nsKeys = n.nsKeys
+		s.sem.Unlock()
+	}
+
+	for _, s := range c.tshards {
+		tags := make(map[Tag]*tags)
+		s.sem.Lock()
+		s.tags = tags
+		s.sem.Unlock()
+	}
 }
 
 func (c *Cache) Clean() {
@@ -198,69 +489,190 @@ func (c *Cache) Clean() {
 }
 
 func (c *Cache) cleanTagKeys(scans int) {
-	c.tsem.RLock()
-	for i := range c.tags {
-		c.tags[i].delNotInCache(c)
-		if scans--; scans <= 0 {
-			break
+	perShard := scans/len(c.tshards) + 1
+	for _, s := range c.tshards {
+		n := perShard
+		s.sem.RLock()
+		for i := range s.tags {
+			s.tags[i].delNotInCache(c)
+			if n--; n <= 0 {
+				break
+			}
 		}
+		s.sem.RUnlock()
 	}
-	c.tsem.RUnlock()
 }
 
 func (c *Cache) cleanTags(scans int) {
-	clear := make([]Tag, 0)
-	c.tsem.RLock()
-	for i := range c.tags {
-		if c.tags[i].IsEmpty() {
-			clear = append(clear, i)
+	perShard := scans/len(c.tshards) + 1
+	for _, s := range c.tshards {
+		n := perShard
+		clear := make([]Tag, 0)
+		s.sem.RLock()
+		for i := range s.tags {
+			if s.tags[i].IsEmpty() {
+				clear = append(clear, i)
+			}
+			if n--; n <= 0 {
+				break
+			}
 		}
-		if scans--; scans <= 0 {
-			break
+		s.sem.RUnlock()
+
+		if len(clear) == 0 {
+			continue
+		}
+
+		s.sem.Lock()
+		for i := range clear {
+			if t, ok := s.tags[clear[i]]; ok && t.IsEmpty() {
+				delete(s.tags, clear[i])
+			}
 		}
+		s.sem.Unlock()
 	}
-	c.tsem.RUnlock()
+}
 
-	if len(clear) == 0 {
-		return
+func (c *Cache) shard(key Key) *shard {
+	return c.shards[hash(string(key))%uint32(len(c.shards))]
+}
+
+func (c *Cache) tagShard(tag Tag) *tagShard {
+	return c.tshards[hash(string(tag))%uint32(len(c.tshards))]
+}
+
+// tagSet returns the key set of a tag, creating it if create is true.
+func (c *Cache) tagSet(tag Tag, create bool) *tags {
+	s := c.tagShard(tag)
+	s.sem.RLock()
+	t := s.tags[tag]
+	s.sem.RUnlock()
+	if t != nil || !create {
+		return t
 	}
 
-	c.tsem.Lock()
-	for i := range clear {
-		delete(c.tags, clear[i])
+	s.sem.Lock()
+	if t = s.tags[tag]; t == nil {
+		t = newTags()
+		s.tags[tag] = t
 	}
-	c.tsem.Unlock()
+	s.sem.Unlock()
+	return t
 }
 
-func (c *Cache) del(key Key) {
-	delete(c.data, key)
+func (c *Cache) has(key Key) bool {
+	s := c.shard(key)
+	s.sem.RLock()
+	_, ok := s.data[key]
+	s.sem.RUnlock()
+	return ok
 }
 
-func (c *Cache) delExpired(scans int) {
-	clear := make([]Key, 0)
-	now := time.Now()
-	c.dsem.RLock()
-	for i := range c.data {
-		if c.data[i].e.Before(now) {
-			clear = append(clear, i)
-		}
+func (c *Cache) del(key Key, reason Reason) Usage {
+	s := c.shard(key)
+	s.sem.Lock()
+	e := s.data[key]
+	u := s.del(key)
+	if u.Keys != 0 {
+		c.j.del(key)
+		c.ev.emit(reason, e)
+	}
+	s.sem.Unlock()
+	return u
+}
 
-		if scans--; scans <= 0 {
-			break
-		}
+// version returns the version of a live key or 0 if it does not exist,
+// caller should hold sem.
+func (s *shard) version(key Key, now time.Time) uint64 {
+	e, ok := s.data[key]
+	if !ok || e.e.Before(now) {
+		return 0
 	}
-	c.dsem.RUnlock()
-	c.dsem.Lock()
-	for i := range clear {
-		c.del(clear[i])
+	return e.v
+}
+
+// del removes a key from the shard, caller should hold sem.
+func (s *shard) del(key Key) Usage {
+	e, ok := s.data[key]
+	if !ok {
+		return Usage{}
 	}
 
-	c.dsem.Unlock()
+	delete(s.data, key)
+	heap.Remove(&s.exp, e.i)
+	return s.account(key, e, false)
+}
+
+// hash is an inlined 32 bit FNV-1a.
+func hash(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
 }
 
 type entry struct {
+	// a is the unix nano time of the last access.
+	a int64
+	h uint64
+	v uint64
+	// i is the index in the expiry heap of the shard.
+	i int
+	k Key
 	d string
 	e time.Time
+	t []Tag
+	f uint32
+	m map[string]string
+	// w is the time of the write that created the entry.
+	w time.Time
+}
+
+func (e *entry) item() Item {
+	var tags []Tag
+	if len(e.t) != 0 {
+		tags = make([]Tag, len(e.t))
+		copy(tags, e.t)
+	}
+
+	return Item{
+		Value:    e.d,
+		Tags:     tags,
+		Expires:  e.e,
+		Version:  e.v,
+		Flags:    e.f,
+		Meta:     copyMeta(e.m),
+		Modified: e.w,
+	}
+}
+
+func copyMeta(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	n := make(map[string]string, len(m))
+	for k, v := range m {
+		n[k] = v
+	}
+	return n
+}
+
+// touch records an access at unix nano time now.
+func (e *entry) touch(now int64) {
+	if now-atomic.LoadInt64(&e.a) > accessResolution {
+		atomic.StoreInt64(&e.a, now)
+	}
+
+	// Increment the hit counter with a decreasing probability once it is
+	// large enough, hot entries are read concurrently and an exact count
+	// is not needed to rank them.
+	h := atomic.LoadUint64(&e.h)
+	if h < 64 || rand.Uint64()%h < 64 {
+		atomic.AddUint64(&e.h, 1)
+	}
 }
 
 type tags struct {
@@ -269,8 +681,7 @@ type tags struct {
 }
 
 func newTags() *tags {
-	var sem sync.RWMutex
-	return &tags{sem, make(map[Key]struct{}, 0)}
+	return &tags{t: make(map[Key]struct{}, 0)}
 }
 
 func (t *tags) get() []Key {
@@ -284,32 +695,34 @@ func (t *tags) get() []Key {
 }
 
 func (t *tags) add(key Key) {
+	t.sem.RLock()
+	_, ok := t.t[key]
+	t.sem.RUnlock()
+	if ok {
+		return
+	}
+
 	t.sem.Lock()
 	t.t[key] = struct{}{}
 	t.sem.Unlock()
 }
 
-func (t *tags) delFromCache(c *Cache) {
-	t.sem.RLock()
-	c.dsem.Lock()
-	for i := range t.t {
-		c.del(i)
+// delFromCache deletes all keys of the tag and returns the amount deleted.
+func (t *tags) delFromCache(c *Cache) int {
+	n := 0
+	for _, k := range t.get() {
+		n += c.del(k, ReasonTag).Keys
 	}
-	c.dsem.Unlock()
-	t.sem.RUnlock()
+	return n
 }
 
 func (t *tags) delNotInCache(c *Cache) {
 	clear := make([]Key, 0)
-	t.sem.RLock()
-	c.dsem.RLock()
-	for i := range t.t {
-		if _, ok := c.data[i]; !ok {
-			clear = append(clear, i)
+	for _, k := range t.get() {
+		if !c.has(k) {
+			clear = append(clear, k)
 		}
 	}
-	c.dsem.RUnlock()
-	t.sem.RUnlock()
 
 	if len(clear) == 0 {
 		return
@@ -1,10 +1,16 @@
 package cache
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io"
+	"io/ioutil"
+	"math"
 	mrand "math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -26,6 +32,14 @@ func newData(random bool) string {
 	return string(data)
 }
 
+func newKeys(n int) []Key {
+	keys := make([]Key, n)
+	for i := range keys {
+		keys[i] = Key(strconv.Itoa(i))
+	}
+	return keys
+}
+
 func BenchmarkSet(b *testing.B) {
 	data := newData(true)
 	expires := time.Now().Add(time.Second * 100)
@@ -41,6 +55,25 @@ func BenchmarkSet(b *testing.B) {
 	})
 }
 
+// BenchmarkSetKeys spreads the load over many keys, and thus shards, unlike
+// BenchmarkSet which measures contention on a single hot key.
+func BenchmarkSetKeys(b *testing.B) {
+	data := newData(true)
+	expires := time.Now().Add(time.Second * 100)
+	cache := newCache()
+	tags := []Tag{"wopla", "dopla"}
+
+	keys := newKeys(1e3)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := mrand.Intn(len(keys))
+		for pb.Next() {
+			i++
+			cache.Set(keys[i%len(keys)], tags, data, expires)
+		}
+	})
+}
+
 func BenchmarkSetAlloc(b *testing.B) {
 	expires := time.Now().Add(time.Second * 100)
 	cache := newCache()
@@ -81,6 +114,52 @@ func BenchmarkGet(b *testing.B) {
 	})
 }
 
+// BenchmarkGetKeys spreads the load over many keys, and thus shards, unlike
+// BenchmarkGet which measures contention on a single hot key.
+func BenchmarkGetKeys(b *testing.B) {
+	data := newData(true)
+	cache := newCache()
+	expires := time.Now().Add(time.Second * 100)
+	tags := []Tag{"wopla", "dopla"}
+	keys := newKeys(1e3)
+	for _, k := range keys {
+		cache.Set(k, tags, data, expires)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := mrand.Intn(len(keys))
+		for pb.Next() {
+			i++
+			if _, ok := cache.Get(keys[i%len(keys)]); !ok {
+				b.Error("OOPS")
+			}
+		}
+	})
+}
+
+// BenchmarkQuotaEvict writes to a namespace at its quota while other
+// namespaces hold many more keys, eviction should not have to scan those.
+func BenchmarkQuotaEvict(b *testing.B) {
+	data := newData(true)
+	cache := newCache()
+	expires := time.Now().Add(time.Second * 100)
+	for _, k := range newKeys(2e5) {
+		cache.Set("other"+NSSep+k, nil, data, expires)
+	}
+
+	cache.SetQuota("ns", Quota{MaxKeys: 100})
+	keys := newKeys(1e3)
+	for _, k := range keys[:100] {
+		cache.Set("ns"+NSSep+k, nil, data, expires)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Set("ns"+NSSep+keys[i%len(keys)], nil, data, expires)
+	}
+}
+
 func BenchmarkDelByTag(b *testing.B) {
 	data := newData(true)
 	cache := newCache()
@@ -112,7 +191,6 @@ func BenchmarkDelByTag(b *testing.B) {
 func BenchmarkDelExpired(b *testing.B) {
 	data := newData(true)
 	cache := newCache()
-	expires := time.Now().Add(-time.Second)
 	var max int = 1e4
 	tags := []Tag{"wopla", "dopla"}
 	for i := 0; i < max; i++ {
@@ -120,16 +198,17 @@ func BenchmarkDelExpired(b *testing.B) {
 			Key(strconv.Itoa(i)),
 			tags,
 			data,
-			expires,
+			time.Now().Add(time.Hour),
 		)
 	}
 
+	expires := time.Now().Add(-time.Second)
+	keys := newKeys(1e2)
 	b.ResetTimer()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			cache.delExpired(1e2)
-		}
-	})
+	for i := 0; i < b.N; i++ {
+		cache.Set("expired"+keys[i%len(keys)], tags, data, expires)
+		cache.DelExpired()
+	}
 }
 
 func BenchmarkClean(b *testing.B) {
@@ -156,29 +235,6 @@ func BenchmarkClean(b *testing.B) {
 	})
 }
 
-// func BenchmarkRecreate(b *testing.B) {
-// 	data := newData(true)
-// 	cache := newCache()
-// 	expires := time.Now().Add(-time.Second)
-// 	var max int = 1e4
-// 	tags := []Tag{"wopla", "dopla"}
-// 	for i := 0; i < max; i++ {
-// 		cache.Set(
-// 			Key(strconv.Itoa(i)),
-// 			tags,
-// 			data,
-// 			expires,
-// 		)
-// 	}
-//
-// 	b.ResetTimer()
-// 	b.RunParallel(func(pb *testing.PB) {
-// 		for pb.Next() {
-// 			cache.Recreate()
-// 		}
-// 	})
-// }
-
 func BenchmarkDelByPrefix(b *testing.B) {
 	data := newData(true)
 	cache := newCache()
@@ -230,7 +286,7 @@ func TestDelTags(t *testing.T) {
 	cache.Set(key, tags, data, time.Now().Add(time.Second*100))
 	cache.Del(key)
 
-	stored := cache.tags[tag]
+	stored := cache.tagSet(tag, false)
 	if stored == nil {
 		t.Fatal("Tag cleared to soon")
 	}
@@ -240,7 +296,7 @@ func TestDelTags(t *testing.T) {
 
 	// Clean tags
 	cache.cleanTags(1e9)
-	stored = cache.tags[tag]
+	stored = cache.tagSet(tag, false)
 	if stored == nil {
 		t.Fatal("Tag cleared to soon")
 	}
@@ -250,7 +306,7 @@ func TestDelTags(t *testing.T) {
 
 	// Clean tag keys
 	cache.cleanTagKeys(1e9)
-	stored = cache.tags[tag]
+	stored = cache.tagSet(tag, false)
 	if stored == nil {
 		t.Fatal("Tag cleared to soon")
 	}
@@ -300,14 +356,24 @@ func TestDelByPrefix(t *testing.T) {
 	cache.Set("prefix:lili", nil, "data", expires)
 	cache.Set("prefix:lulu", nil, "data", expires)
 	cache.Set("some-key", nil, "data", expires)
+	cache.Set("ns"+NSSep+"key", nil, "data", expires)
+	cache.Set(NSSep+"key", nil, "data", expires)
+
+	// Namespace prefixes only purge their own namespace.
+	cache.DelByPrefix("ns" + NSSep)
+	cache.DelByPrefix(NSSep)
+	if cache.Len() != 5 {
+		t.Fatalf("Expected 5 keys after purging namespaces, got %d", cache.Len())
+	}
 
 	cache.DelByPrefix("prefix:")
 
-	for i := range cache.data {
+	cache.IterateKeys(func(i Key) bool {
 		if i != "some-key" {
 			t.Fatalf("%s should not exist", i)
 		}
-	}
+		return true
+	})
 
 	if _, ok := cache.Get("some-key"); !ok {
 		t.Fatalf("Key not should exist")
@@ -345,3 +411,565 @@ func TestGetTagKeys(t *testing.T) {
 		}
 	}
 }
+
+func TestEvictLRU(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Second * 100)
+	for i := 0; i < 10; i++ {
+		cache.Set(Key(strconv.Itoa(i)), nil, "data", expires)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	for _, k := range []Key{"0", "1", "2"} {
+		if _, ok := cache.Get(k); !ok {
+			t.Fatalf("Key %s should exist", k)
+		}
+	}
+
+	cache.Evict(7)
+	if cache.Len() != 3 {
+		t.Fatalf("Expected 3 keys, got %d", cache.Len())
+	}
+
+	for _, k := range []Key{"0", "1", "2"} {
+		if _, ok := cache.Get(k); !ok {
+			t.Fatalf("Recently used key %s was evicted", k)
+		}
+	}
+}
+
+func TestEvictLFU(t *testing.T) {
+	cache := newCache()
+	cache.SetPolicy(LFU)
+	expires := time.Now().Add(time.Second * 100)
+	for i := 0; i < 10; i++ {
+		cache.Set(Key(strconv.Itoa(i)), nil, "data", expires)
+	}
+
+	for i := 0; i < 3; i++ {
+		cache.Get("9")
+	}
+
+	// Most recent access but only once.
+	for i := 0; i < 9; i++ {
+		cache.Get(Key(strconv.Itoa(i)))
+	}
+
+	cache.Evict(9)
+	if _, ok := cache.Get("9"); !ok || cache.Len() != 1 {
+		t.Fatal("Most frequently used key was evicted")
+	}
+}
+
+func TestEvictTTL(t *testing.T) {
+	cache := newCache()
+	cache.SetPolicy(TTL)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		cache.Set(Key(strconv.Itoa(i)), nil, "data", now.Add(time.Duration(i+1)*time.Minute))
+	}
+
+	cache.Evict(5)
+	for i := 0; i < 10; i++ {
+		_, ok := cache.Get(Key(strconv.Itoa(i)))
+		if ok != (i >= 5) {
+			t.Fatalf("Key %d: expected exists=%t", i, i >= 5)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, n := range []string{"lru", "LFU", "ttl", "random"} {
+		if _, err := ParsePolicy(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ParsePolicy("fifo"); err == nil {
+		t.Fatal("Expected an error for an unknown policy")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Second * 100)
+	cache.Set("ns"+NSSep+"uno", []Tag{"ns" + NSSep + "tag"}, "data", expires)
+	cache.Set("ns"+NSSep+"dos", nil, "data", expires)
+	cache.Set("tres", nil, "datadata", expires)
+
+	u := cache.NamespaceUsage("ns")
+	if u.Keys != 2 || u.KeyBytes != 12 || u.ValueBytes != 8 {
+		t.Fatalf("Unexpected namespace usage: %+v", u)
+	}
+	if u.TagBytes != 6+refSize*2 {
+		t.Fatalf("Unexpected tag usage: %d", u.TagBytes)
+	}
+
+	total := cache.Usage()
+	if total.Keys != 3 || total.ValueBytes != 16 {
+		t.Fatalf("Unexpected usage: %+v", total)
+	}
+
+	cache.Set("tres", nil, "data", expires)
+	if v := cache.Usage().ValueBytes; v != 12 {
+		t.Fatalf("Overwrite not accounted for: %d", v)
+	}
+
+	cache.DelByPrefix("ns" + NSSep)
+	if u := cache.NamespaceUsage("ns"); u.Keys != 0 || u.Bytes() != 0 {
+		t.Fatalf("Namespace usage not cleared: %+v", u)
+	}
+
+	if l := len(cache.Namespaces()); l != 1 {
+		t.Fatalf("Expected 1 namespace, got %d", l)
+	}
+
+	cache.DelAll()
+	if u := cache.Usage(); u.Bytes() != 0 {
+		t.Fatalf("Usage not cleared: %+v", u)
+	}
+}
+
+func TestEvictBytes(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Second * 100)
+	for i := 0; i < 100; i++ {
+		cache.Set(Key(strconv.Itoa(i)), nil, newData(false), expires)
+	}
+
+	before := cache.Usage().Bytes()
+	freed := cache.EvictBytes(before / 2)
+	if freed < before/2 {
+		t.Fatalf("Freed %d bytes, wanted %d", freed, before/2)
+	}
+
+	if after := cache.Usage().Bytes(); after != before-freed {
+		t.Fatalf("Usage %d does not match %d - %d", after, before, freed)
+	}
+
+	if cache.Len() < 45 {
+		t.Fatalf("Evicted too much, %d keys left", cache.Len())
+	}
+}
+
+func TestQuotaEvict(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Second * 100)
+	ns := func(k string) Key { return Key("ns" + NSSep + k) }
+	cache.SetQuota("ns", Quota{MaxKeys: 3})
+	cache.Set("other", nil, "data", expires)
+	for i := 0; i < 5; i++ {
+		if err := cache.Set(ns(strconv.Itoa(i)), nil, "data", expires); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if u := cache.NamespaceUsage("ns"); u.Keys != 3 {
+		t.Fatalf("Expected 3 keys in namespace, got %d", u.Keys)
+	}
+
+	for _, k := range []Key{"other", ns("2"), ns("3"), ns("4")} {
+		if _, ok := cache.Get(k); !ok {
+			t.Fatalf("Key %s should exist", k)
+		}
+	}
+}
+
+func TestQuotaReject(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Second * 100)
+	key := Key("ns" + NSSep + "key")
+	cache.SetQuota("ns", Quota{MaxBytes: 200, Reject: true})
+	if err := cache.Set(key, nil, "data", expires); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Set(key+"2", nil, newData(false), expires); err != ErrQuota {
+		t.Fatalf("Expected ErrQuota, got %v", err)
+	}
+
+	cache.SetQuota("ns", Quota{})
+	if err := cache.Set(key+"2", nil, newData(false), expires); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelExpired(t *testing.T) {
+	cache := newCache()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		cache.Set(Key(strconv.Itoa(i)), nil, "data", now.Add(time.Duration(i-50)*time.Minute+time.Second))
+	}
+
+	// Overwrite an expired key with one that is not and vice versa.
+	cache.Set("0", nil, "data", now.Add(time.Hour))
+	cache.Set("99", nil, "data", now.Add(-time.Hour))
+
+	if n := cache.DelExpired(); n != 50 {
+		t.Fatalf("Expected 50 keys to expire, got %d", n)
+	}
+
+	if n := cache.DelExpired(); n != 0 {
+		t.Fatalf("Expected no keys to expire, got %d", n)
+	}
+
+	if _, ok := cache.Get("0"); !ok {
+		t.Fatal("Overwritten key expired")
+	}
+
+	cache.Del("0")
+	if l := cache.Len(); l != 49 {
+		t.Fatalf("Expected 49 keys, got %d", l)
+	}
+
+	for _, s := range cache.shards {
+		if len(s.exp) != len(s.data) {
+			t.Fatalf("Expiry index out of sync: %d != %d", len(s.exp), len(s.data))
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	cache := newCache()
+	now := time.Now()
+	cache.Set("ns"+NSSep+"uno", []Tag{"ns" + NSSep + "tag"}, "data1", now.Add(time.Hour))
+	cache.Set("dos", nil, newData(true), now.Add(time.Hour))
+	cache.Set("tres", []Tag{"tag"}, "data3", now.Add(-time.Second))
+	cache.Set("forever", nil, "data4", now.Add(math.MaxInt64))
+	cache.SetItem("flags", Item{
+		Value:   "data5",
+		Expires: now.Add(time.Hour),
+		Flags:   42,
+		Meta:    map[string]string{"Content-Type": "text/plain", "X-Meta-A": "a"},
+	})
+
+	buf := bytes.NewBuffer(nil)
+	if err := cache.WriteSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newCache()
+	n, err := restored.ReadSnapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 4 || restored.Len() != 4 {
+		t.Fatalf("Expected 4 entries, loaded %d", n)
+	}
+
+	item, _ := restored.GetItem("flags")
+	if item.Flags != 42 {
+		t.Fatalf("Flags not restored: %d", item.Flags)
+	}
+	if len(item.Meta) != 2 || item.Meta["Content-Type"] != "text/plain" || item.Meta["X-Meta-A"] != "a" {
+		t.Fatalf("Meta not restored: %v", item.Meta)
+	}
+	if orig, _ := cache.GetItem("flags"); orig.Modified.IsZero() || !item.Modified.Equal(orig.Modified) {
+		t.Fatalf("Modified time not restored: %s != %s", item.Modified, orig.Modified)
+	}
+
+	for _, k := range []Key{"ns" + NSSep + "uno", "dos", "forever"} {
+		exp, _ := cache.Get(k)
+		if v, ok := restored.Get(k); !ok || v != exp {
+			t.Fatalf("Key %s not restored", k)
+		}
+	}
+
+	if keys := restored.GetTagKeys("ns" + NSSep + "tag"); len(keys) != 1 {
+		t.Fatal("Tags not restored")
+	}
+
+	if restored.NamespaceUsage("ns") != cache.NamespaceUsage("ns") {
+		t.Fatal("Namespace usage differs")
+	}
+
+	if _, err := restored.ReadSnapshot(bytes.NewReader([]byte("garbage"))); err != ErrSnapshotFormat {
+		t.Fatalf("Expected ErrSnapshotFormat, got %v", err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webis-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal")
+	snapshot := filepath.Join(dir, "snapshot")
+	j, err := OpenJournal(path, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	cache := newCache()
+	cache.SetJournal(j)
+	cache.Set("uno", []Tag{"tag"}, "data", expires)
+	cache.Set("dos", []Tag{"tag"}, "data", expires)
+	cache.Set("tres", nil, "data", expires)
+	cache.Set("ns"+NSSep+"cuatro", nil, "data", expires)
+	cache.Set("cinco", nil, "data", expires)
+	if err := cache.Compact(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.DelByTag("tag")
+	cache.Del("tres")
+	cache.DelByPrefix("ns" + NSSep)
+	cache.SetItem("seis", Item{Value: "data", Expires: expires, Meta: map[string]string{"a": "b"}})
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash halfway through a write.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{opSet, 10, 'a'})
+	f.Close()
+
+	restore := func() *Cache {
+		restored := newCache()
+		if _, err := restored.LoadSnapshot(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := restored.ReplayJournal(path); err != nil {
+			t.Fatal(err)
+		}
+		return restored
+	}
+
+	restored := restore()
+	if restored.Len() != 2 {
+		t.Fatalf("Expected 2 keys, got %d", restored.Len())
+	}
+	for _, k := range []Key{"cinco", "seis"} {
+		if _, ok := restored.Get(k); !ok {
+			t.Fatalf("Key %s not restored", k)
+		}
+	}
+	item, _ := restored.GetItem("seis")
+	if item.Meta["a"] != "b" {
+		t.Fatalf("Meta not replayed: %v", item.Meta)
+	}
+	if orig, _ := cache.GetItem("seis"); !item.Modified.Equal(orig.Modified) {
+		t.Fatalf("Modified time not replayed: %s != %s", item.Modified, orig.Modified)
+	}
+
+	// The torn record should be gone so new records can be appended.
+	j, err = OpenJournal(path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.SetJournal(j)
+	restored.DelAll()
+	restored.Set("siete", nil, "data", expires)
+	j.Close()
+
+	restored = restore()
+	if _, ok := restored.Get("siete"); !ok || restored.Len() != 1 {
+		t.Fatal("Records appended after a torn write were not replayed")
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Hour)
+	v1, err := cache.CompareAndSet("key", nil, "uno", expires, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cache.CompareAndSet("key", nil, "dos", expires, 0); err != ErrVersion {
+		t.Fatalf("Expected ErrVersion, got %v", err)
+	}
+
+	v2, err := cache.CompareAndSet("key", nil, "dos", expires, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v2 <= v1 {
+		t.Fatalf("Version did not increase: %d <= %d", v2, v1)
+	}
+
+	if _, err := cache.CompareAndSet("key", nil, "tres", expires, v1); err != ErrVersion {
+		t.Fatalf("Expected ErrVersion, got %v", err)
+	}
+
+	if item, ok := cache.GetItem("key"); !ok || item.Value != "dos" || item.Version != v2 {
+		t.Fatalf("Unexpected item %+v", item)
+	}
+
+	// Versions survive a snapshot and new ones are higher.
+	buf := bytes.NewBuffer(nil)
+	if err := cache.WriteSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newCache()
+	if _, err := restored.ReadSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if item, _ := restored.GetItem("key"); item.Version != v2 {
+		t.Fatalf("Version not restored: %d != %d", item.Version, v2)
+	}
+
+	if v, _ := restored.CompareAndSet("other", nil, "data", expires, 0); v <= v2 {
+		t.Fatalf("New version %d not higher than restored %d", v, v2)
+	}
+
+	// Nor are versions reused by a restart that lost them.
+	if v, _ := newCache().CompareAndSet("key", nil, "cuatro", expires, 0); v <= v2 {
+		t.Fatalf("Version %d reused after a restart, last was %d", v, v2)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Hour)
+	if n, err := cache.Incr("counter", []Tag{"tag"}, 1, 10, expires); err != nil || n != 11 {
+		t.Fatalf("Expected 11, got %d (%v)", n, err)
+	}
+
+	if n, err := cache.Incr("counter", nil, -5, 0, time.Now()); err != nil || n != 6 {
+		t.Fatalf("Expected 6, got %d (%v)", n, err)
+	}
+
+	item, _ := cache.GetItem("counter")
+	if !item.Expires.Equal(expires) || len(item.Tags) != 1 {
+		t.Fatalf("Expiry or tags of existing counter changed: %+v", item)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 100; j++ {
+				cache.Incr("counter", nil, 1, 0, expires)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := cache.Get("counter"); v != "806" {
+		t.Fatalf("Concurrent increments lost: %s", v)
+	}
+
+	cache.Set("string", nil, "data", expires)
+	if _, err := cache.Incr("string", nil, 1, 0, expires); err != ErrNotInteger {
+		t.Fatalf("Expected ErrNotInteger, got %v", err)
+	}
+
+	cache.Set("max", nil, strconv.FormatInt(math.MaxInt64, 10), expires)
+	if _, err := cache.Incr("max", nil, 1, 0, expires); err != ErrOverflow {
+		t.Fatalf("Expected ErrOverflow, got %v", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	cache := newCache()
+	cache.Set("key", []Tag{"tag"}, "data", time.Now().Add(time.Second))
+	expires := time.Now().Add(time.Hour)
+	if ok, err := cache.Touch("key", expires); !ok || err != nil {
+		t.Fatalf("Touch failed: %v %v", ok, err)
+	}
+
+	item, _ := cache.GetItem("key")
+	if !item.Expires.Equal(expires) || item.Value != "data" || item.Tags[0] != "tag" {
+		t.Fatalf("Unexpected item %+v", item)
+	}
+
+	if ok, _ := cache.Touch("missing", expires); ok {
+		t.Fatal("Touched a missing key")
+	}
+
+	if !cache.Del("key") || cache.Del("key") {
+		t.Fatal("Del did not report existence")
+	}
+}
+
+func TestStats(t *testing.T) {
+	cache := newCache()
+	expires := time.Now().Add(time.Hour)
+	cache.Set("a", []Tag{"tag"}, "data", expires)
+	cache.Set("b", []Tag{"tag"}, "data", expires)
+	cache.Set("ns\x00c", nil, "data", expires)
+	cache.Set("d", nil, "data", time.Now().Add(-time.Second))
+	cache.Set("e", nil, "data", expires)
+	cache.Set("f", nil, "data", expires)
+
+	cache.Get("a")
+	cache.GetItem("a")
+	cache.Get("missing")
+	cache.Get("d")
+	cache.Incr("n", nil, 1, 0, expires)
+
+	cache.DelExpired()
+	cache.DelByTag("tag")
+	cache.DelByPrefix("ns\x00")
+	cache.Evict(1)
+	cache.DelAll()
+
+	expect := Stats{
+		Hits:       2,
+		Misses:     2,
+		Expired:    1,
+		Evicted:    1,
+		TagDeleted: 2,
+		Purged:     3,
+	}
+	if s := cache.Stats(); s != expect {
+		t.Fatalf("Expected %+v, got %+v", expect, s)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cache := newCache()
+	sub := cache.Subscribe(10, func(ev Event) bool { return ev.Key != "ignored" })
+	expires := time.Now().Add(time.Hour)
+	cache.Set("a", []Tag{"tag"}, "data", expires)
+	cache.Set("ignored", nil, "data", expires)
+	cache.Set("b", nil, "data", time.Now().Add(-time.Second))
+	cache.Set("c", nil, "data", expires)
+	cache.Del("c")
+	cache.DelByTag("tag")
+	cache.DelExpired()
+
+	expect := []Event{
+		{ReasonSet, "a", []Tag{"tag"}},
+		{ReasonSet, "b", nil},
+		{ReasonSet, "c", nil},
+		{ReasonDel, "c", nil},
+		{ReasonTag, "a", []Tag{"tag"}},
+		{ReasonExpired, "b", nil},
+	}
+	for _, e := range expect {
+		ev := <-sub.C
+		if ev.Reason != e.Reason || ev.Key != e.Key || len(ev.Tags) != len(e.Tags) {
+			t.Fatalf("Expected %+v, got %+v", e, ev)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		cache.Set("a", nil, "data", expires)
+	}
+	for range sub.C {
+	}
+	if !sub.Lost() {
+		t.Fatal("Subscription not lost after overflowing")
+	}
+
+	sub = cache.Subscribe(1, nil)
+	sub.Close()
+	sub.Close()
+	cache.Set("a", nil, "data", expires)
+	if _, ok := <-sub.C; ok {
+		t.Fatal("Received an event after closing")
+	}
+}
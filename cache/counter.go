@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotInteger = errors.New("Value is not an integer")
+	ErrOverflow   = errors.New("Increment would overflow")
+)
+
+// Incr atomically adds delta to the integer stored at key and returns the
+// result. A missing key starts out at initial before delta is applied and
+// gets the given tags and expiry, an existing key keeps its expiry and
+// has tags added to its own.
+func (c *Cache) Incr(
+	key Key,
+	tags []Tag,
+	delta,
+	initial int64,
+	expires time.Time,
+) (int64, error) {
+	for {
+		n := initial
+		var version uint64
+		item := Item{Tags: tags, Expires: expires}
+		if cur, ok := c.getItem(key); ok {
+			var err error
+			if n, err = strconv.ParseInt(cur.Value, 10, 64); err != nil {
+				return 0, ErrNotInteger
+			}
+			item, version = cur, cur.Version
+			item.Tags = mergeTags(cur.Tags, tags)
+		}
+
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return 0, ErrOverflow
+		}
+		n += delta
+
+		item.Value = strconv.FormatInt(n, 10)
+		_, err := c.set(c.itemEntry(key, item), &version)
+		if err != ErrVersion {
+			return n, err
+		}
+	}
+}
+
+func mergeTags(a, b []Tag) []Tag {
+	if len(b) == 0 {
+		return a
+	}
+
+	l := a
+	for _, t := range b {
+		found := false
+		for _, e := range a {
+			if e == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			l = append(l, t)
+		}
+	}
+
+	return l
+}
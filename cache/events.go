@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Reason describes why an Event was emitted.
+type Reason string
+
+const (
+	// ReasonSet is a key being created or overwritten.
+	ReasonSet Reason = "set"
+	// ReasonDel is a key being deleted with Del.
+	ReasonDel Reason = "del"
+	// ReasonTag is a key being deleted by DelByTag.
+	ReasonTag Reason = "tag"
+	// ReasonPurge is a key being deleted by DelByPrefix or DelAll.
+	ReasonPurge Reason = "purge"
+	// ReasonExpired is an expired key being removed.
+	ReasonExpired Reason = "expired"
+	// ReasonEvicted is a key being evicted to free memory.
+	ReasonEvicted Reason = "evicted"
+	// ReasonQuota is a key being evicted to make room in its namespace quota.
+	ReasonQuota Reason = "quota"
+)
+
+// Event describes a change to a single key.
+// Tags are shared with the cache and should not be modified.
+type Event struct {
+	Reason Reason
+	Key    Key
+	Tags   []Tag
+}
+
+// Subscription receives events on C until it is closed. A subscriber that
+// does not keep up loses its subscription, C is then closed and Lost
+// returns true.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	filter func(Event) bool
+	lost   int32
+	bus    *bus
+}
+
+// Lost reports whether the subscription was dropped because its buffer
+// was full.
+func (s *Subscription) Lost() bool {
+	return atomic.LoadInt32(&s.lost) == 1
+}
+
+// Close stops the subscription and closes C.
+func (s *Subscription) Close() {
+	s.bus.remove(s)
+}
+
+type bus struct {
+	sem  sync.RWMutex
+	subs map[*Subscription]struct{}
+	n    int32
+}
+
+func newBus() *bus {
+	return &bus{subs: make(map[*Subscription]struct{})}
+}
+
+// active reports whether there are any subscribers, so callers can skip
+// gathering events nobody listens to.
+func (b *bus) active() bool {
+	return atomic.LoadInt32(&b.n) != 0
+}
+
+func (b *bus) emit(reason Reason, e *entry) {
+	if !b.active() {
+		return
+	}
+
+	ev := Event{Reason: reason, Key: e.k, Tags: e.t}
+	b.sem.RLock()
+	for s := range b.subs {
+		if atomic.LoadInt32(&s.lost) == 1 || (s.filter != nil && !s.filter(ev)) {
+			continue
+		}
+
+		select {
+		case s.c <- ev:
+		default:
+			if atomic.CompareAndSwapInt32(&s.lost, 0, 1) {
+				// Closing requires the write lock.
+				go b.remove(s)
+			}
+		}
+	}
+	b.sem.RUnlock()
+}
+
+func (b *bus) remove(s *Subscription) {
+	b.sem.Lock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		atomic.AddInt32(&b.n, -1)
+		close(s.c)
+	}
+	b.sem.Unlock()
+}
+
+// Subscribe returns a subscription to all changes for which filter
+// returns true, or all changes if filter is nil. Events are buffered up to
+// buffer events. The filter is called while the cache holds locks and must
+// not call into the cache.
+func (c *Cache) Subscribe(buffer int, filter func(Event) bool) *Subscription {
+	ch := make(chan Event, buffer)
+	s := &Subscription{C: ch, c: ch, filter: filter, bus: c.ev}
+	c.ev.sem.Lock()
+	c.ev.subs[s] = struct{}{}
+	atomic.AddInt32(&c.ev.n, 1)
+	c.ev.sem.Unlock()
+	return s
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stat holds the bookkeeping of an entry an eviction Policy can base
+// its decision on.
+type Stat struct {
+	// Accessed is the time of the last Set or Get with a resolution
+	// of about a millisecond.
+	Accessed time.Time
+	// Hits is the amount of successful Gets, increments become less
+	// likely once it passes 64 so it is only exact for cold entries.
+	Hits    uint64
+	Expires time.Time
+}
+
+// Policy decides which entries are evicted first by scoring them,
+// the lowest scores go first.
+type Policy interface {
+	Score(s Stat) int64
+}
+
+// PolicyFunc allows using an ordinary function as a Policy.
+type PolicyFunc func(s Stat) int64
+
+func (p PolicyFunc) Score(s Stat) int64 { return p(s) }
+
+var (
+	// LRU evicts the least recently used entries.
+	LRU Policy = PolicyFunc(func(s Stat) int64 { return s.Accessed.UnixNano() })
+	// LFU evicts the least frequently used entries.
+	LFU Policy = PolicyFunc(func(s Stat) int64 { return int64(s.Hits) })
+	// TTL evicts the entries that expire soonest.
+	TTL Policy = PolicyFunc(func(s Stat) int64 { return s.Expires.UnixNano() })
+	// Random evicts arbitrary entries.
+	Random Policy = PolicyFunc(func(s Stat) int64 { return rand.Int63() })
+)
+
+var policies = map[string]Policy{
+	"lru":    LRU,
+	"lfu":    LFU,
+	"ttl":    TTL,
+	"random": Random,
+}
+
+// Policies returns the names of all policies known to ParsePolicy.
+func Policies() []string {
+	l := make([]string, 0, len(policies))
+	for i := range policies {
+		l = append(l, i)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// ParsePolicy returns the Policy by its (case insensitive) name.
+func ParsePolicy(name string) (Policy, error) {
+	p, ok := policies[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf(
+			"Unknown eviction policy '%s', valid: %s",
+			name,
+			strings.Join(Policies(), ", "),
+		)
+	}
+
+	return p, nil
+}
+
+type scored struct {
+	s int64
+	k Key
+}
+
+// scoreHeap is a max-heap on score, used to retain the n lowest scoring
+// entries while scanning the whole map once.
+type scoreHeap []scored
+
+func (h scoreHeap) Len() int            { return len(h) }
+func (h scoreHeap) Less(i, j int) bool  { return h[i].s > h[j].s }
+func (h scoreHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scoreHeap) Push(x interface{}) { *h = append(*h, x.(scored)) }
+func (h *scoreHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// victims returns the n lowest scoring keys in ascending order, only those
+// in namespace ns if it is not nil, never including skip.
+// Shards are locked one at a time so the result might be slightly stale.
+func (c *Cache) victims(p Policy, n int, ns *string, skip Key) []Key {
+	h := make(scoreHeap, 0, n)
+	for _, sh := range c.shards {
+		sh.sem.RLock()
+		data := sh.data
+		if ns != nil {
+			data = sh.nsKeys[*ns]
+		}
+		for k, e := range data {
+			if k == skip {
+				continue
+			}
+
+			s := p.Score(e.stat())
+			if len(h) < n {
+				heap.Push(&h, scored{s, k})
+				continue
+			}
+
+			if s < h[0].s {
+				h[0] = scored{s, k}
+				heap.Fix(&h, 0)
+			}
+		}
+		sh.sem.RUnlock()
+	}
+
+	sort.Slice(h, func(i, j int) bool { return h[i].s < h[j].s })
+	keys := make([]Key, len(h))
+	for i := range h {
+		keys[i] = h[i].k
+	}
+
+	return keys
+}
+
+func (e *entry) stat() Stat {
+	return Stat{
+		time.Unix(0, atomic.LoadInt64(&e.a)),
+		atomic.LoadUint64(&e.h),
+		e.e,
+	}
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// expiry is a min-heap of entries on expiration time, each entry tracks
+// its own index so it can be removed when deleted or overwritten.
+type expiry []*entry
+
+func (h expiry) Len() int           { return len(h) }
+func (h expiry) Less(i, j int) bool { return h[i].e.Before(h[j].e) }
+func (h expiry) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i = i
+	h[j].i = j
+}
+
+func (h *expiry) Push(x interface{}) {
+	e := x.(*entry)
+	e.i = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiry) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.i = -1
+	*h = old[:n-1]
+	return e
+}
+
+// delExpired removes all entries that expired before now from the shard,
+// emits them on ev and returns the amount removed.
+func (s *shard) delExpired(now time.Time, ev *bus) int {
+	s.sem.RLock()
+	none := len(s.exp) == 0 || !s.exp[0].e.Before(now)
+	s.sem.RUnlock()
+	if none {
+		return 0
+	}
+
+	n := 0
+	s.sem.Lock()
+	for len(s.exp) != 0 && s.exp[0].e.Before(now) {
+		ev.emit(ReasonExpired, s.exp[0])
+		s.del(s.exp[0].k)
+		n++
+	}
+	s.sem.Unlock()
+	return n
+}
+
+// DelExpired removes all expired entries. Its cost scales with the amount
+// of expired entries, not with the size of the cache.
+func (c *Cache) DelExpired() int {
+	n := 0
+	now := time.Now()
+	for _, s := range c.shards {
+		n += s.delExpired(now, c.ev)
+	}
+	atomic.AddUint64(&c.stats.Expired, uint64(n))
+	return n
+}
@@ -0,0 +1,394 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	journalMagic = "WEBISJ"
+	// journalVersion 2 added entry versions, 3 entry flags, 4 entry meta,
+	// 5 entry modified times.
+	journalVersion = 5
+
+	opSet       = 1
+	opDel       = 2
+	opDelPrefix = 3
+	opDelAll    = 4
+)
+
+// SyncPolicy decides how often the journal is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves it up to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncSecond syncs at most once per second, a crash loses at most
+	// one second of writes.
+	SyncSecond
+	// SyncAlways syncs after every operation.
+	SyncAlways
+)
+
+var syncPolicies = map[string]SyncPolicy{
+	"never":  SyncNever,
+	"second": SyncSecond,
+	"always": SyncAlways,
+}
+
+// ParseSyncPolicy returns the SyncPolicy by its name: never, second or always.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	p, ok := syncPolicies[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown sync policy '%s', valid: never, second, always", name)
+	}
+	return p, nil
+}
+
+// Journal is an append-only log of all cache mutations. It is replayed on
+// top of the latest snapshot on startup and truncated by Cache.Compact.
+//
+// Set and Del are logged while their shard is locked so the log order
+// matches the in-memory order for each key. Tag deletions are logged as
+// the key deletions they cause since the tag index is not replayed.
+type Journal struct {
+	sem    sync.Mutex
+	path   string
+	f      *os.File
+	enc    *encoder
+	policy SyncPolicy
+	size   int64
+	dirty  bool
+	err    error
+	done   chan struct{}
+}
+
+// OpenJournal opens or creates the journal at path for appending.
+// Replay it with Cache.ReplayJournal before opening it.
+func OpenJournal(path string, policy SyncPolicy) (*Journal, error) {
+	j := &Journal{path: path, policy: policy, done: make(chan struct{})}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+
+	if policy == SyncSecond {
+		go j.syncer()
+	}
+
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	if err := j.upgrade(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	j.f = f
+	j.size = stat.Size()
+	j.enc = newEncoder(f)
+	if j.size == 0 {
+		j.enc.raw([]byte(journalMagic))
+		j.enc.uvarint(journalVersion)
+		j.flush()
+	}
+
+	return j.err
+}
+
+// upgrade moves a journal in an older format aside as if a compaction was
+// interrupted, so new records are not appended in a different format.
+func (j *Journal) upgrade() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	dec := newDecoder(f)
+	magic := make([]byte, len(journalMagic))
+	dec.raw(magic)
+	version := dec.uvarint()
+	f.Close()
+	if dec.err == io.EOF || version == journalVersion {
+		return nil
+	}
+
+	old := j.path + ".old"
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		return fmt.Errorf(
+			"%s: journal version %d needs to be compacted first",
+			j.path,
+			version,
+		)
+	}
+
+	return os.Rename(j.path, old)
+}
+
+func (j *Journal) syncer() {
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-time.After(time.Second):
+		}
+
+		j.sem.Lock()
+		if j.dirty && j.err == nil {
+			j.err = j.f.Sync()
+			j.dirty = false
+		}
+		j.sem.Unlock()
+	}
+}
+
+// flush writes the buffered record, caller should hold sem.
+func (j *Journal) flush() {
+	j.size += int64(j.enc.w.Buffered())
+	if err := j.enc.flush(); err != nil && j.err == nil {
+		j.err = err
+	}
+
+	j.dirty = true
+	if j.policy == SyncAlways && j.err == nil {
+		j.err = j.f.Sync()
+		j.dirty = false
+	}
+}
+
+// Size returns the current size of the journal in bytes.
+func (j *Journal) Size() int64 {
+	j.sem.Lock()
+	s := j.size
+	j.sem.Unlock()
+	return s
+}
+
+// Err returns the first write error, once one occurs the journal
+// can no longer be trusted until the next compaction.
+func (j *Journal) Err() error {
+	j.sem.Lock()
+	err := j.err
+	j.sem.Unlock()
+	return err
+}
+
+// Close syncs and closes the journal.
+func (j *Journal) Close() error {
+	close(j.done)
+	j.sem.Lock()
+	defer j.sem.Unlock()
+	if j.err == nil {
+		j.err = j.f.Sync()
+	}
+	if err := j.f.Close(); err != nil && j.err == nil {
+		j.err = err
+	}
+	return j.err
+}
+
+// rotate moves the current journal aside to path.old and starts a new one.
+func (j *Journal) rotate() error {
+	j.sem.Lock()
+	defer j.sem.Unlock()
+	if j.err == nil {
+		j.err = j.f.Sync()
+	}
+	j.f.Close()
+	if err := os.Rename(j.path, j.path+".old"); err != nil {
+		if oerr := j.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+
+	j.err = nil
+	return j.open()
+}
+
+func (j *Journal) set(e *entry) {
+	if j == nil {
+		return
+	}
+	j.sem.Lock()
+	j.enc.byte(opSet)
+	j.enc.entry(e)
+	j.flush()
+	j.sem.Unlock()
+}
+
+func (j *Journal) del(key Key) {
+	j.op(opDel, string(key))
+}
+
+// delKeys logs the removal of keys with a single flush.
+func (j *Journal) delKeys(keys []Key) {
+	if j == nil || len(keys) == 0 {
+		return
+	}
+	j.sem.Lock()
+	for _, k := range keys {
+		j.enc.byte(opDel)
+		j.enc.string(string(k))
+	}
+	j.flush()
+	j.sem.Unlock()
+}
+
+func (j *Journal) delAll() {
+	j.op(opDelAll, "")
+}
+
+func (j *Journal) op(op byte, arg string) {
+	if j == nil {
+		return
+	}
+	j.sem.Lock()
+	j.enc.byte(op)
+	j.enc.string(arg)
+	j.flush()
+	j.sem.Unlock()
+}
+
+// SetJournal makes the cache log all mutations to j. It should be called
+// before the cache is used concurrently.
+func (c *Cache) SetJournal(j *Journal) {
+	c.j = j
+}
+
+// Compact saves a snapshot to path and truncates the journal, all
+// operations in the journal are part of the snapshot.
+func (c *Cache) Compact(snapshot string) error {
+	j := c.j
+	if j == nil {
+		return c.SaveSnapshot(snapshot)
+	}
+
+	// If a previous compaction failed its journal is still around and
+	// the current journal is kept as well, the snapshot covers both.
+	old := j.path + ".old"
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.SaveSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	return os.Remove(old)
+}
+
+// ReplayJournal applies all operations in the journal at path, and the one
+// left behind by an interrupted compaction, and returns the amount applied.
+// A record torn by a crash is truncated. A missing journal is not an error.
+func (c *Cache) ReplayJournal(path string) (int, error) {
+	n, err := c.replayJournal(path + ".old")
+	if err != nil {
+		return n, err
+	}
+
+	m, err := c.replayJournal(path)
+	return n + m, err
+}
+
+func (c *Cache) replayJournal(path string) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	cr := &countReader{r: f}
+	dec := &decoder{r: bufio.NewReader(cr)}
+	magic := make([]byte, len(journalMagic))
+	dec.raw(magic)
+	version := dec.uvarint()
+	if dec.err != nil || string(magic) != journalMagic {
+		return 0, fmt.Errorf("%s: not a webis journal", path)
+	}
+	if version < 1 || version > journalVersion {
+		return 0, fmt.Errorf("%s: unsupported journal version %d", path, version)
+	}
+
+	n := 0
+	now := time.Now()
+	for {
+		valid := cr.n - int64(dec.r.Buffered())
+		op := dec.byte()
+		if dec.err == io.EOF {
+			return n, nil
+		}
+
+		switch op {
+		case opSet:
+			e := dec.entry(version)
+			if dec.err == nil && !e.e.Before(now) {
+				if err := c.restore(e); err != nil && err != ErrQuota {
+					return n, err
+				}
+			}
+		case opDel:
+			if key := Key(dec.string()); dec.err == nil {
+				c.Del(key)
+			}
+		case opDelPrefix:
+			// Only written by older versions, prefix purges are now
+			// journaled as the keys they removed.
+			if prefix := Key(dec.string()); dec.err == nil {
+				c.DelByPrefix(prefix)
+			}
+		case opDelAll:
+			if dec.string(); dec.err == nil {
+				c.DelAll()
+			}
+		default:
+			if dec.err == nil {
+				dec.err = ErrSnapshotFormat
+			}
+		}
+
+		if dec.err == io.EOF || dec.err == io.ErrUnexpectedEOF {
+			// Everything after the last complete record is a partial
+			// write, drop it so future appends remain readable.
+			return n, f.Truncate(valid)
+		}
+		if dec.err != nil {
+			return n, fmt.Errorf("%s: %s", path, dec.err)
+		}
+		n++
+	}
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQuota is returned when a write does not fit in its namespace quota.
+var ErrQuota = errors.New("Namespace quota exceeded")
+
+// Quota limits the memory and amount of keys a namespace can use.
+// A zero limit means unlimited.
+type Quota struct {
+	MaxBytes uint64
+	MaxKeys  int
+	// Reject makes writes that exceed the quota fail with ErrQuota
+	// instead of evicting other entries in the namespace.
+	Reject bool
+}
+
+func (q Quota) exceeded(u Usage) bool {
+	return (q.MaxBytes != 0 && u.Bytes() > q.MaxBytes) ||
+		(q.MaxKeys != 0 && u.Keys > q.MaxKeys)
+}
+
+// SetQuota configures the quota of a namespace, a zero Quota removes it.
+// Existing entries are not evicted until the next write to the namespace.
+func (c *Cache) SetQuota(ns string, q Quota) {
+	c.qsem.Lock()
+	m := c.Quotas()
+	if q.MaxBytes == 0 && q.MaxKeys == 0 {
+		delete(m, ns)
+	} else {
+		m[ns] = q
+	}
+	c.quotas.Store(m)
+	c.qsem.Unlock()
+}
+
+// Quotas returns all configured namespace quotas.
+func (c *Cache) Quotas() map[string]Quota {
+	cur := c.quotas.Load().(map[string]Quota)
+	m := make(map[string]Quota, len(cur))
+	for i := range cur {
+		m[i] = cur[i]
+	}
+	return m
+}
+
+// reserve makes room for e in the quota of its namespace.
+// Concurrent writes to the same namespace might overshoot the quota slightly
+// as the namespace usage is spread over all shards.
+func (c *Cache) reserve(key Key, e *entry) error {
+	ns := key.Namespace()
+	q, ok := c.quotas.Load().(map[string]Quota)[ns]
+	if !ok {
+		return nil
+	}
+
+	size := e.usage(key)
+	if q.exceeded(size) {
+		return ErrQuota
+	}
+
+	used := c.NamespaceUsage(ns)
+	s := c.shard(key)
+	s.sem.RLock()
+	if old, ok := s.data[key]; ok {
+		used.sub(old.usage(key))
+	}
+	s.sem.RUnlock()
+	used.add(size)
+
+	if !q.exceeded(used) {
+		return nil
+	}
+
+	if q.Reject {
+		return ErrQuota
+	}
+
+	p := c.getPolicy()
+	for q.exceeded(used) {
+		batch := 1
+		if q.MaxKeys != 0 && used.Keys-q.MaxKeys > batch {
+			batch = used.Keys - q.MaxKeys
+		}
+		if q.MaxBytes != 0 && used.Bytes() > q.MaxBytes {
+			avg := used.Bytes() / uint64(used.Keys)
+			if b := int((used.Bytes()-q.MaxBytes)/(avg+1)) + 1; b > batch {
+				batch = b
+			}
+		}
+
+		victims := c.victims(p, batch, &ns, key)
+		if len(victims) == 0 {
+			return ErrQuota
+		}
+
+		for _, k := range victims {
+			u := c.del(k, ReasonQuota)
+			used.sub(u)
+			atomic.AddUint64(&c.stats.QuotaEvicted, uint64(u.Keys))
+			if !q.exceeded(used) {
+				break
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,331 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	snapshotMagic = "WEBIS"
+	// snapshotVersion 2 added entry versions, 3 entry flags, 4 entry meta,
+	// 5 entry modified times.
+	snapshotVersion = 5
+
+	recordEntry = 1
+	recordEnd   = 0
+
+	// maxLen guards against allocating absurd amounts of memory
+	// when reading a corrupt file.
+	maxLen = 1 << 30
+)
+
+var ErrSnapshotFormat = errors.New("Not a webis snapshot")
+
+// WriteSnapshot writes all live entries to w. Shards are copied one at
+// a time so the snapshot is consistent per shard but not across shards.
+func (c *Cache) WriteSnapshot(w io.Writer) error {
+	enc := newEncoder(w)
+	enc.raw([]byte(snapshotMagic))
+	enc.uvarint(snapshotVersion)
+
+	now := time.Now()
+	var entries []*entry
+	for _, s := range c.shards {
+		entries = entries[:0]
+		s.sem.RLock()
+		for _, e := range s.data {
+			entries = append(entries, e)
+		}
+		s.sem.RUnlock()
+
+		for _, e := range entries {
+			if e.e.Before(now) {
+				continue
+			}
+			enc.byte(recordEntry)
+			enc.entry(e)
+		}
+
+		if enc.err != nil {
+			return enc.err
+		}
+	}
+
+	enc.byte(recordEnd)
+	return enc.flush()
+}
+
+// ReadSnapshot loads all entries from a snapshot written by WriteSnapshot
+// skipping those that expired in the meantime and returns the amount loaded.
+func (c *Cache) ReadSnapshot(r io.Reader) (int, error) {
+	dec := newDecoder(r)
+	magic := make([]byte, len(snapshotMagic))
+	dec.raw(magic)
+	version := dec.uvarint()
+	if dec.err != nil || string(magic) != snapshotMagic {
+		return 0, ErrSnapshotFormat
+	}
+
+	if version < 1 || version > snapshotVersion {
+		return 0, fmt.Errorf("Unsupported snapshot version %d", version)
+	}
+
+	n := 0
+	now := time.Now()
+	for {
+		switch dec.byte() {
+		case recordEnd:
+			return n, dec.err
+		case recordEntry:
+			e := dec.entry(version)
+			if dec.err != nil {
+				return n, dec.err
+			}
+			if e.e.Before(now) {
+				continue
+			}
+			if err := c.restore(e); err != nil {
+				if err == ErrQuota {
+					continue
+				}
+				return n, err
+			}
+			n++
+		default:
+			if dec.err != nil {
+				return n, dec.err
+			}
+			return n, ErrSnapshotFormat
+		}
+	}
+}
+
+// SaveSnapshot atomically replaces the snapshot at path.
+func (c *Cache) SaveSnapshot(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	if err = c.WriteSnapshot(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// LoadSnapshot reads the snapshot at path, a missing file is not an error.
+func (c *Cache) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	return c.ReadSnapshot(f)
+}
+
+// restore stores a decoded entry, keeping its version if it has one.
+func (c *Cache) restore(e *entry) error {
+	n := c.newEntry(e.k, e.t, e.d, e.e, e.v)
+	n.f = e.f
+	n.m = e.m
+	if !e.w.IsZero() {
+		n.w = e.w
+	}
+	_, err := c.set(n, nil)
+	return err
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func newEncoder(w io.Writer) *encoder {
+	return &encoder{w: bufio.NewWriter(w)}
+}
+
+func (e *encoder) raw(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) byte(b byte) {
+	if e.err == nil {
+		e.err = e.w.WriteByte(b)
+	}
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.raw(e.buf[:binary.PutUvarint(e.buf[:], v)])
+}
+
+func (e *encoder) varint(v int64) {
+	e.raw(e.buf[:binary.PutVarint(e.buf[:], v)])
+}
+
+func (e *encoder) string(v string) {
+	e.uvarint(uint64(len(v)))
+	if e.err == nil {
+		_, e.err = e.w.WriteString(v)
+	}
+}
+
+func (e *encoder) entry(en *entry) {
+	e.string(string(en.k))
+	e.uvarint(uint64(len(en.t)))
+	for _, t := range en.t {
+		e.string(string(t))
+	}
+	e.string(en.d)
+	e.time(en.e)
+	e.uvarint(en.v)
+	e.uvarint(uint64(en.f))
+
+	names := make([]string, 0, len(en.m))
+	for name := range en.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e.uvarint(uint64(len(names)))
+	for _, name := range names {
+		e.string(name)
+		e.string(en.m[name])
+	}
+	e.time(en.w)
+}
+
+// time encodes t as seconds and nanoseconds since UnixNano only
+// covers the years 1678 through 2262.
+func (e *encoder) time(t time.Time) {
+	e.varint(t.Unix())
+	e.uvarint(uint64(t.Nanosecond()))
+}
+
+func (e *encoder) flush() error {
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{r: bufio.NewReader(r)}
+}
+
+func (d *decoder) raw(b []byte) {
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b)
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	var b byte
+	b, d.err = d.r.ReadByte()
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var v uint64
+	v, d.err = binary.ReadUvarint(d.r)
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	var v int64
+	v, d.err = binary.ReadVarint(d.r)
+	return v
+}
+
+func (d *decoder) string() string {
+	l := d.uvarint()
+	if d.err == nil && l > maxLen {
+		d.err = ErrSnapshotFormat
+	}
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, l)
+	d.raw(b)
+	return string(b)
+}
+
+// entry decodes an entry as encoded by the given snapshot or journal
+// format version, both added the entry version in their version 2,
+// flags in 3, meta in 4 and the modified time in 5.
+func (d *decoder) entry(format uint64) *entry {
+	e := &entry{k: Key(d.string())}
+	if n := d.uvarint(); n != 0 && d.err == nil {
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			e.t = append(e.t, Tag(d.string()))
+		}
+	}
+	e.d = d.string()
+	e.e = d.time()
+	if format >= 2 {
+		e.v = d.uvarint()
+	}
+	if format >= 3 {
+		e.f = uint32(d.uvarint())
+	}
+	if format >= 4 {
+		if n := d.uvarint(); n != 0 && d.err == nil {
+			if n > maxLen {
+				d.err = ErrSnapshotFormat
+				return e
+			}
+			e.m = make(map[string]string)
+			for i := uint64(0); i < n && d.err == nil; i++ {
+				name := d.string()
+				e.m[name] = d.string()
+			}
+		}
+	}
+	if format >= 5 {
+		e.w = d.time()
+	}
+	return e
+}
+
+func (d *decoder) time() time.Time {
+	sec := d.varint()
+	nsec := d.uvarint()
+	return time.Unix(sec, int64(nsec))
+}
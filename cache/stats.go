@@ -0,0 +1,43 @@
+package cache
+
+import "sync/atomic"
+
+// Stats counts lookups and removals since the cache was created.
+type Stats struct {
+	// Hits and Misses count Get and GetItem calls.
+	Hits   uint64
+	Misses uint64
+
+	// Expired counts entries removed by DelExpired.
+	Expired uint64
+	// Evicted counts entries removed by Evict and EvictBytes.
+	Evicted uint64
+	// QuotaEvicted counts entries evicted to make room in a namespace quota.
+	QuotaEvicted uint64
+	// TagDeleted counts entries removed by DelByTag.
+	TagDeleted uint64
+	// Purged counts entries removed by DelByPrefix and DelAll.
+	Purged uint64
+}
+
+// Stats returns a copy of the current counters.
+func (c *Cache) Stats() Stats {
+	s := &c.stats
+	return Stats{
+		Hits:         atomic.LoadUint64(&s.Hits),
+		Misses:       atomic.LoadUint64(&s.Misses),
+		Expired:      atomic.LoadUint64(&s.Expired),
+		Evicted:      atomic.LoadUint64(&s.Evicted),
+		QuotaEvicted: atomic.LoadUint64(&s.QuotaEvicted),
+		TagDeleted:   atomic.LoadUint64(&s.TagDeleted),
+		Purged:       atomic.LoadUint64(&s.Purged),
+	}
+}
+
+func (c *Cache) lookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.stats.Hits, 1)
+		return
+	}
+	atomic.AddUint64(&c.stats.Misses, 1)
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// NSSep separates a namespace from the key or tag it prefixes.
+const NSSep = "\x00"
+
+const (
+	entrySize = uint64(unsafe.Sizeof(entry{}))
+	// refSize is the cost of a string header referring to a key or tag.
+	refSize = uint64(unsafe.Sizeof(""))
+)
+
+// Usage describes the memory used by a set of entries in bytes.
+type Usage struct {
+	Keys int
+	// KeyBytes is the size of the keys themselves.
+	KeyBytes uint64
+	// ValueBytes is the size of the stored values.
+	ValueBytes uint64
+	// TagBytes is the size of the tag names and the references
+	// the tag index holds to each key.
+	TagBytes uint64
+	// Overhead is the size of the per entry bookkeeping.
+	Overhead uint64
+}
+
+// Bytes returns the total amount of bytes used.
+func (u Usage) Bytes() uint64 {
+	return u.KeyBytes + u.ValueBytes + u.TagBytes + u.Overhead
+}
+
+func (u *Usage) add(o Usage) {
+	u.Keys += o.Keys
+	u.KeyBytes += o.KeyBytes
+	u.ValueBytes += o.ValueBytes
+	u.TagBytes += o.TagBytes
+	u.Overhead += o.Overhead
+}
+
+func (u *Usage) sub(o Usage) {
+	u.Keys -= o.Keys
+	u.KeyBytes -= o.KeyBytes
+	u.ValueBytes -= o.ValueBytes
+	u.TagBytes -= o.TagBytes
+	u.Overhead -= o.Overhead
+}
+
+// Namespace returns the namespace of a key, or an empty string if it has none.
+func (k Key) Namespace() string {
+	if i := strings.Index(string(k), NSSep); i != -1 {
+		return string(k[:i])
+	}
+	return ""
+}
+
+func (e *entry) usage(key Key) Usage {
+	u := Usage{
+		Keys:       1,
+		KeyBytes:   uint64(len(key)),
+		ValueBytes: uint64(len(e.d)),
+		Overhead:   entrySize,
+	}
+
+	for _, t := range e.t {
+		u.TagBytes += uint64(len(t)) + refSize*2
+	}
+
+	for k, v := range e.m {
+		u.ValueBytes += uint64(len(k)+len(v)) + refSize*2
+	}
+
+	return u
+}
+
+// Usage returns the memory used by all entries.
+func (c *Cache) Usage() Usage {
+	var u Usage
+	for _, s := range c.shards {
+		s.sem.RLock()
+		u.add(s.usage)
+		s.sem.RUnlock()
+	}
+	return u
+}
+
+// NamespaceUsage returns the memory used by all entries in the given namespace.
+func (c *Cache) NamespaceUsage(ns string) Usage {
+	var u Usage
+	for _, s := range c.shards {
+		s.sem.RLock()
+		if n, ok := s.nsUsage[ns]; ok {
+			u.add(*n)
+		}
+		s.sem.RUnlock()
+	}
+	return u
+}
+
+// Namespaces returns the memory usage of each namespace that holds entries.
+func (c *Cache) Namespaces() map[string]Usage {
+	m := make(map[string]Usage)
+	for _, s := range c.shards {
+		s.sem.RLock()
+		for i := range s.nsUsage {
+			u := m[i]
+			u.add(*s.nsUsage[i])
+			m[i] = u
+		}
+		s.sem.RUnlock()
+	}
+	return m
+}
+
+// account adds or removes an entry from the usage totals,
+// caller should hold sem.
+func (s *shard) account(key Key, e *entry, add bool) Usage {
+	u := e.usage(key)
+	ns := key.Namespace()
+	n, ok := s.nsUsage[ns]
+	if !ok {
+		n = &Usage{}
+		s.nsUsage[ns] = n
+	}
+
+	keys := s.nsKeys[ns]
+	if add {
+		if keys == nil {
+			keys = make(map[Key]*entry)
+			s.nsKeys[ns] = keys
+		}
+		keys[key] = e
+		s.usage.add(u)
+		n.add(u)
+		return u
+	}
+
+	delete(keys, key)
+	s.usage.sub(u)
+	n.sub(u)
+	if n.Keys == 0 {
+		delete(s.nsUsage, ns)
+		delete(s.nsKeys, ns)
+	}
+
+	return u
+}
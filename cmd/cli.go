@@ -1,24 +1,92 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/frizinak/webis/server"
 )
 
 type CLI struct {
-	ns string
-	ep string
-	c  *http.Client
+	ns    string
+	ep    string
+	c     *http.Client
+	token string
 }
 
+// UnixPrefix marks an endpoint as a unix socket path, e.g.
+// unix:///run/webis.sock
+const UnixPrefix = "unix://"
+
 func NewCLI(ns, ep string) *CLI {
+	if strings.HasPrefix(ep, UnixPrefix) {
+		path := ep[len(UnixPrefix):]
+		t := &http.Transport{
+			MaxIdleConnsPerHost: 1000,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return &CLI{ns: ns, ep: "http://unix", c: &http.Client{Transport: t}}
+	}
+
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1000
-	return &CLI{ns, ep, &http.Client{}}
+	return &CLI{ns: ns, ep: ep, c: &http.Client{}}
+}
+
+// ClientTLS creates a tls configuration that trusts the CAs in caFile, or
+// the system roots if it is empty, and presents the client certificate in
+// certFile and keyFile if they are not empty.
+func ClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := server.LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// SetTLS configures the client for https endpoints.
+func (c *CLI) SetTLS(cfg *tls.Config) {
+	t, ok := c.c.Transport.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+		c.c.Transport = t
+	}
+	t.TLSClientConfig = cfg
+}
+
+// SetToken makes all requests authenticate with a bearer token.
+func (c *CLI) SetToken(token string) {
+	c.token = token
+}
+
+func (c *CLI) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.ep+path, body)
+	if err == nil && c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, err
 }
 
 func (c *CLI) Set(
@@ -27,7 +95,52 @@ func (c *CLI) Set(
 	r io.Reader,
 	ttl string,
 ) (int, []byte, error) {
-	req, err := http.NewRequest("POST", c.ep+"/set", r)
+	req, err := c.newRequest("POST", "/set", r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req.Header[server.HeaderKey] = []string{key}
+	req.Header[server.HeaderTags] = tags
+	req.Header[server.HeaderNS] = []string{c.ns}
+	req.Header[server.HeaderTTL] = []string{ttl}
+
+	return c.do(req)
+}
+
+// CompareAndSet only sets key if its current version equals version,
+// "0" meaning it should not exist yet.
+func (c *CLI) CompareAndSet(
+	key string,
+	tags []string,
+	r io.Reader,
+	ttl string,
+	version string,
+) (int, []byte, error) {
+	req, err := c.newRequest("POST", "/set", r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req.Header[server.HeaderKey] = []string{key}
+	req.Header[server.HeaderTags] = tags
+	req.Header[server.HeaderNS] = []string{c.ns}
+	req.Header[server.HeaderTTL] = []string{ttl}
+	req.Header[server.HeaderExpectVersion] = []string{version}
+
+	return c.do(req)
+}
+
+// Incr adds delta to the counter at key, initial is its starting value if
+// it does not exist yet. Empty strings use the server defaults.
+func (c *CLI) Incr(
+	key string,
+	tags []string,
+	delta string,
+	initial string,
+	ttl string,
+) (int, []byte, error) {
+	req, err := c.newRequest("POST", "/incr", nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -36,12 +149,14 @@ func (c *CLI) Set(
 	req.Header[server.HeaderTags] = tags
 	req.Header[server.HeaderNS] = []string{c.ns}
 	req.Header[server.HeaderTTL] = []string{ttl}
+	req.Header[server.HeaderDelta] = []string{delta}
+	req.Header[server.HeaderInitial] = []string{initial}
 
 	return c.do(req)
 }
 
 func (c *CLI) Get(key string, tags []string) (int, io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", c.ep+"/get", nil)
+	req, err := c.newRequest("GET", "/get", nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -62,7 +177,7 @@ func (c *CLI) Get(key string, tags []string) (int, io.ReadCloser, error) {
 }
 
 func (c *CLI) Del(key string, tags []string) (int, []byte, error) {
-	req, err := http.NewRequest("POST", c.ep+"/del", nil)
+	req, err := c.newRequest("POST", "/del", nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -75,7 +190,7 @@ func (c *CLI) Del(key string, tags []string) (int, []byte, error) {
 }
 
 func (c *CLI) Purge() (int, []byte, error) {
-	req, err := http.NewRequest("POST", c.ep+"/purge", nil)
+	req, err := c.newRequest("POST", "/purge", nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -86,7 +201,7 @@ func (c *CLI) Purge() (int, []byte, error) {
 }
 
 func (c *CLI) PurgeAll() (int, []byte, error) {
-	req, err := http.NewRequest("POST", c.ep+"/purge-all", nil)
+	req, err := c.newRequest("POST", "/purge-all", nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -95,7 +210,7 @@ func (c *CLI) PurgeAll() (int, []byte, error) {
 }
 
 func (c *CLI) List(key string, tags []string) (int, io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", c.ep+"/list", nil)
+	req, err := c.newRequest("GET", "/list", nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -29,6 +29,7 @@ func main() {
 	methodGet := flag.Bool("G", false, "GET")
 	methodDel := flag.Bool("D", false, "DEL")
 	methodList := flag.Bool("L", false, "LIST")
+	methodIncr := flag.Bool("I", false, "INCR")
 	methodPurge := flag.Bool("PURGE", false, "PURGE")
 	methodPurgeAll := flag.Bool("PURGE-ALL", false, "PURGE")
 	data := flag.String("d", "", "Data")
@@ -36,9 +37,17 @@ func main() {
 	key := flag.String("k", "", "Key")
 	ns := flag.String("ns", "", "Namespace")
 	ttl := flag.String("ttl", "", "ttl")
+	delta := flag.String("delta", "", "INCR delta, negative to decrement")
+	initial := flag.String("initial", "", "INCR starting value")
+	version := flag.String("cas", "", "Only SET if the current version matches, 0 if it should not exist")
 	flag.Var(&tags, "t", "Tags")
 
-	host := flag.String("u", "localhost:3200", "Host")
+	token := flag.String("a", os.Getenv("WEBIS_TOKEN"), "Bearer token, defaults to $WEBIS_TOKEN")
+	tlsCA := flag.String("tca", "", "CA file to verify the server with, system roots by default")
+	tlsCert := flag.String("tc", "", "Client certificate file")
+	tlsKey := flag.String("tk", "", "Client certificate key file")
+
+	host := flag.String("u", "localhost:3200", "Host or unix:///path/to/socket")
 	flag.Parse()
 
 	var reader io.Reader
@@ -53,7 +62,9 @@ func main() {
 		reader = f
 	}
 
-	if !strings.HasPrefix(*host, "http://") && !strings.HasPrefix(*host, "https://") {
+	if !strings.HasPrefix(*host, "http://") &&
+		!strings.HasPrefix(*host, "https://") &&
+		!strings.HasPrefix(*host, cmd.UnixPrefix) {
 		*host = "http://" + *host
 	}
 	ep, err := url.Parse(*host)
@@ -68,6 +79,7 @@ func main() {
 		*methodGet,
 		*methodDel,
 		*methodList,
+		*methodIncr,
 		*methodPurge,
 		*methodPurgeAll,
 	} {
@@ -82,7 +94,16 @@ func main() {
 	}
 
 	cli := cmd.NewCLI(*ns, ep.String())
-	if *methodSet {
+	cli.SetToken(*token)
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		cfg, err := cmd.ClientTLS(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cli.SetTLS(cfg)
+	}
+	if *methodSet || *methodIncr {
 		if *key == "" {
 			fmt.Fprintln(os.Stderr, "No key specified (-k)")
 			os.Exit(1)
@@ -90,6 +111,8 @@ func main() {
 	}
 
 	switch {
+	case *methodSet && *version != "":
+		cmd.Print(cli.CompareAndSet(*key, tags, reader, *ttl, *version))
 	case *methodSet:
 		cmd.Print(cli.Set(*key, tags, reader, *ttl))
 	case *methodGet:
@@ -98,6 +121,8 @@ func main() {
 		cmd.Print(cli.Del(*key, tags))
 	case *methodList:
 		cmd.PrintReader(cli.List(*key, tags))
+	case *methodIncr:
+		cmd.Print(cli.Incr(*key, tags, *delta, *initial, *ttl))
 	case *methodPurge:
 		cmd.Print(cli.Purge())
 	case *methodPurgeAll:
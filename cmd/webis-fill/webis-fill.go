@@ -31,7 +31,12 @@ func main() {
 	delete := flag.Bool("D", false, "Delete afterwards")
 	workers := flag.Int("J", 8, "Workers")
 
-	host := flag.String("u", "", "Host")
+	token := flag.String("a", os.Getenv("WEBIS_TOKEN"), "Bearer token, defaults to $WEBIS_TOKEN")
+	tlsCA := flag.String("tca", "", "CA file to verify the server with, system roots by default")
+	tlsCert := flag.String("tc", "", "Client certificate file")
+	tlsKey := flag.String("tk", "", "Client certificate key file")
+
+	host := flag.String("u", "", "Host or unix:///path/to/socket")
 	flag.Parse()
 
 	if *workers < 1 {
@@ -48,7 +53,9 @@ func main() {
 		input = raw
 	}
 
-	if !strings.HasPrefix(*host, "http://") && !strings.HasPrefix(*host, "https://") {
+	if !strings.HasPrefix(*host, "http://") &&
+		!strings.HasPrefix(*host, "https://") &&
+		!strings.HasPrefix(*host, cmd.UnixPrefix) {
 		*host = "http://" + *host
 	}
 	ep, err := url.Parse(*host)
@@ -57,6 +64,15 @@ func main() {
 		os.Exit(1)
 	}
 	cli := cmd.NewCLI(*ns, ep.String())
+	cli.SetToken(*token)
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		cfg, err := cmd.ClientTLS(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cli.SetTLS(cfg)
+	}
 
 	var wg sync.WaitGroup
 	work := make(chan *entry, *workers)
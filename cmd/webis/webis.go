@@ -1,30 +1,459 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"os/user"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/frizinak/webis/cache"
+	"github.com/frizinak/webis/memcache"
 	"github.com/frizinak/webis/proc"
+	"github.com/frizinak/webis/proxy"
+	"github.com/frizinak/webis/resp"
 	"github.com/frizinak/webis/server"
 )
 
+type quotas map[string]cache.Quota
+
+func (q quotas) String() string {
+	return "Quotas"
+}
+
+// Set parses <namespace>=<max-KiB>:<max-keys>[:reject].
+func (q quotas) Set(v string) error {
+	p := strings.SplitN(v, "=", 2)
+	if len(p) != 2 {
+		return errors.New("Expected <namespace>=<max-KiB>:<max-keys>[:reject]")
+	}
+
+	l := strings.Split(p[1], ":")
+	if len(l) < 2 || len(l) > 3 {
+		return errors.New("Expected <namespace>=<max-KiB>:<max-keys>[:reject]")
+	}
+
+	var quota cache.Quota
+	kib, err := strconv.ParseUint(l[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	quota.MaxBytes = kib * 1024
+
+	if quota.MaxKeys, err = strconv.Atoi(l[1]); err != nil {
+		return err
+	}
+
+	if len(l) == 3 {
+		if l[2] != server.QuotaReject && l[2] != server.QuotaEvict {
+			return fmt.Errorf("Invalid quota mode '%s'", l[2])
+		}
+		quota.Reject = l[2] == server.QuotaReject
+	}
+
+	q[p[0]] = quota
+	return nil
+}
+
+type clientNamespaces map[string][]string
+
+func (c clientNamespaces) String() string {
+	return "Client namespaces"
+}
+
+// Set parses <subject>=<namespace>[,<namespace>...].
+func (c clientNamespaces) Set(v string) error {
+	i := strings.LastIndex(v, "=")
+	if i == -1 {
+		return errors.New("Expected <subject>=<namespace>[,<namespace>...]")
+	}
+
+	c[v[:i]] = append(c[v[:i]], strings.Split(v[i+1:], ",")...)
+	return nil
+}
+
+// owner parses <user>[:<group>] as names or ids, omitted parts are -1.
+func owner(v string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if v == "" {
+		return
+	}
+
+	p := strings.SplitN(v, ":", 2)
+	if p[0] != "" {
+		if uid, err = strconv.Atoi(p[0]); err != nil {
+			var u *user.User
+			if u, err = user.Lookup(p[0]); err != nil {
+				return
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(p) == 2 && p[1] != "" {
+		if gid, err = strconv.Atoi(p[1]); err != nil {
+			var g *user.Group
+			if g, err = user.LookupGroup(p[1]); err != nil {
+				return
+			}
+			gid, err = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return
+}
+
 func main() {
-	addr := flag.String("u", "localhost:3200", "Interface:port to listen on")
+	quota := make(quotas)
+	addr := flag.String("u", "localhost:3200", "Interface:port to listen on, empty to only use -us")
+	socket := flag.String("us", "", "Unix socket path to listen on")
+	socketMode := flag.String("um", "0660", "Unix socket file mode")
+	socketOwner := flag.String("uo", "", "Unix socket owner <user>[:<group>]")
+	tokens := flag.String(
+		"a",
+		"",
+		"Json file with bearer tokens, reloaded on SIGHUP: "+
+			`{"tokens": [{"token": "..", "namespaces": ["ns-*"], "ops": ["read", "write", "delete", "purge", "purge-all", "admin"]}]}`,
+	)
+	tlsCert := flag.String("tc", "", "TLS certificate file, enables https, reloaded on SIGHUP")
+	tlsKey := flag.String("tk", "", "TLS key file")
+	tlsCA := flag.String("tca", "", "CA file to verify required client certificates with")
+	clientNS := make(clientNamespaces)
+	flag.Var(
+		clientNS,
+		"tns",
+		"Namespaces a client certificate has access to "+
+			"<subject>=<namespace>[,<namespace>...], the subject is the common name "+
+			"or full distinguished name, namespaces can contain * wildcards and * "+
+			"allows everything, can be specified multiple times, requires -tca",
+	)
 	max := flag.Uint64("m", 512, "Memory limit in MiB")
 	bodyMax := flag.Int("b", 2048, "Post body size limit in KiB")
 	verbose := flag.Bool("v", false, "Verbose")
+	policyName := flag.String(
+		"e",
+		"lru",
+		fmt.Sprintf(
+			"Eviction policy when the memory limit is reached (%s)",
+			strings.Join(cache.Policies(), ", "),
+		),
+	)
+	flag.Var(
+		quota,
+		"q",
+		"Namespace quota <namespace>=<max-KiB>:<max-keys>[:reject], "+
+			"0 is unlimited, can be specified multiple times",
+	)
+	snapshot := flag.String(
+		"s",
+		"",
+		"Snapshot file to restore from on startup and periodically save to",
+	)
+	snapshotInterval := flag.Duration(
+		"si",
+		time.Minute*5,
+		"Snapshot interval, 0 to only save on SIGTERM",
+	)
+	journal := flag.String(
+		"j",
+		"",
+		"Append-only journal file replayed on top of the snapshot on startup, requires -s",
+	)
+	journalSync := flag.String(
+		"js",
+		"second",
+		"Journal fsync policy (never, second, always)",
+	)
+	journalMax := flag.Int64(
+		"jc",
+		64,
+		"Compact the journal into the snapshot once it exceeds this size in MiB",
+	)
+	respAddr := flag.String(
+		"r",
+		"",
+		"Interface:port to serve the Redis protocol on, empty to disable",
+	)
+	respSep := flag.String(
+		"rs",
+		"",
+		"Namespace separator in Redis keys, e.g. ':' maps ns:key to key in namespace ns",
+	)
+	mcAddr := flag.String(
+		"mc",
+		"",
+		"Interface:port to serve the memcached text protocol on, empty to disable",
+	)
+	mcNS := flag.String(
+		"mcns",
+		"",
+		"Namespace memcached keys are stored in",
+	)
+	proxyAddr := flag.String(
+		"p",
+		"",
+		"Interface:port to serve a caching reverse proxy on, empty to disable",
+	)
+	proxyUpstream := flag.String(
+		"pu",
+		"",
+		"Upstream url of the reverse proxy",
+	)
+	proxyNS := flag.String(
+		"pns",
+		"proxy",
+		"Namespace reverse proxy responses are stored in",
+	)
+	drain := flag.Duration(
+		"dt",
+		time.Second*10,
+		"Time to let active requests finish on SIGTERM",
+	)
+	nsMetrics := flag.Bool(
+		"mn",
+		false,
+		"Include per namespace key and byte counts in /metrics",
+	)
 	flag.Parse()
 
+	if *addr == "" && *socket == "" {
+		fmt.Fprintln(os.Stderr, "Nothing to listen on, specify -u and/or -us")
+		os.Exit(1)
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid socket mode")
+		os.Exit(1)
+	}
+
+	if (*tlsKey != "" || *tlsCA != "") && *tlsCert == "" {
+		fmt.Fprintln(os.Stderr, "-tk and -tca require a certificate (-tc)")
+		os.Exit(1)
+	}
+
+	if len(clientNS) != 0 && *tlsCA == "" {
+		fmt.Fprintln(os.Stderr, "-tns requires client certificate verification (-tca)")
+		os.Exit(1)
+	}
+
+	var upstream *url.URL
+	if *proxyAddr != "" {
+		if upstream, err = url.Parse(*proxyUpstream); err != nil || upstream.Host == "" {
+			fmt.Fprintln(os.Stderr, "A reverse proxy (-p) requires an upstream url (-pu)")
+			os.Exit(1)
+		}
+	}
+
+	uid, gid, err := owner(*socketOwner)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	syncPolicy, err := cache.ParseSyncPolicy(*journalSync)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *journal != "" && *snapshot == "" {
+		fmt.Fprintln(os.Stderr, "A journal (-j) requires a snapshot file (-s)")
+		os.Exit(1)
+	}
+
+	policy, err := cache.ParsePolicy(*policyName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	hardMaxMem := *max * 1024 * 1024
 	softMaxMem := uint64(0.95 * float64(hardMaxMem))
 
 	logger := log.New(os.Stderr, "", log.LstdFlags)
-	cache := cache.New()
+	c := cache.New()
+	c.SetPolicy(policy)
+	for ns, q := range quota {
+		c.SetQuota(ns, q)
+	}
+
+	serverLogger := log.New(ioutil.Discard, "", 0)
+	if *verbose {
+		serverLogger = logger
+	}
+
+	srv := server.New(
+		*addr,
+		serverLogger,
+		c,
+		*bodyMax*1024,
+		time.Second*5,
+		time.Second,
+	)
+	srv.SetNamespaceMetrics(*nsMetrics)
+
+	var reload []func()
+	if *tlsCert != "" {
+		cert, err := server.LoadCertificate(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		var pool *x509.CertPool
+		if *tlsCA != "" {
+			if pool, err = server.LoadCertPool(*tlsCA); err != nil {
+				logger.Fatal(err)
+			}
+			if len(clientNS) != 0 {
+				srv.SetClientNamespaces(clientNS)
+			}
+		}
+		srv.SetTLS(server.TLSConfig(cert, pool))
+
+		reload = append(reload, func() {
+			if err := cert.Reload(); err != nil {
+				logger.Printf("TLS: %s", err)
+				return
+			}
+			logger.Println("TLS: certificate reloaded")
+		})
+	}
+
+	if *tokens != "" {
+		if *mcAddr != "" {
+			logger.Fatal("-a can not be combined with -mc, the memcached protocol has no authentication")
+		}
+
+		t, err := server.LoadTokens(*tokens)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		srv.SetTokens(t)
+
+		reload = append(reload, func() {
+			t, err := server.LoadTokens(*tokens)
+			if err != nil {
+				logger.Printf("Tokens: %s", err)
+				return
+			}
+			srv.SetTokens(t)
+			logger.Printf("Tokens: reloaded %d", len(t))
+		})
+	}
+
+	if len(reload) != 0 {
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGHUP)
+			for range sig {
+				for _, r := range reload {
+					r()
+				}
+			}
+		}()
+	}
+
+	var l net.Listener
+	if *socket != "" {
+		if l, err = server.ListenUnix(*socket, os.FileMode(mode), uid, gid); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	// Listen while the snapshot loads so /healthz and /readyz respond.
+	srv.SetReady(false)
+	serve := func(f func() error) {
+		switch err := f(); err {
+		case http.ErrServerClosed, resp.ErrServerClosed, memcache.ErrServerClosed:
+		default:
+			logger.Fatal(err)
+		}
+	}
+
+	// Servers are shut down in order before the final snapshot.
+	shutdown := []func(context.Context) error{srv.Shutdown}
+
+	logger.Println("Starting")
+	if l != nil {
+		go serve(func() error { return srv.Serve(l) })
+	}
+	if *addr != "" {
+		go serve(srv.Start)
+	}
+
+	var savem sync.Mutex
+	save := func() {
+		savem.Lock()
+		defer savem.Unlock()
+		start := time.Now()
+		if err := c.Compact(*snapshot); err != nil {
+			logger.Printf("Snapshot: %s", err)
+			return
+		}
+		logger.Printf("Snapshot: saved in %s", time.Since(start))
+	}
+
+	var j *cache.Journal
+	if *snapshot != "" {
+		start := time.Now()
+		n, err := c.LoadSnapshot(*snapshot)
+		if err != nil {
+			logger.Fatalf("Snapshot: %s", err)
+		}
+		logger.Printf("Snapshot: restored %d keys in %s", n, time.Since(start))
+
+		if *journal != "" {
+			start = time.Now()
+			n, err = c.ReplayJournal(*journal)
+			if err != nil {
+				logger.Fatalf("Journal: %s", err)
+			}
+			logger.Printf("Journal: replayed %d operations in %s", n, time.Since(start))
+
+			if j, err = cache.OpenJournal(*journal, syncPolicy); err != nil {
+				logger.Fatalf("Journal: %s", err)
+			}
+			c.SetJournal(j)
+
+			go func() {
+				for {
+					time.Sleep(time.Second * 10)
+					if err := j.Err(); err != nil {
+						logger.Printf("Journal: %s", err)
+					}
+					if j.Size() > *journalMax*1024*1024 {
+						save()
+					}
+				}
+			}()
+		}
+
+		if *snapshotInterval > 0 {
+			go func() {
+				for {
+					time.Sleep(*snapshotInterval)
+					save()
+				}
+			}()
+		}
+	}
 
 	debug.SetGCPercent(10)
 	p, err := proc.New(
@@ -32,12 +461,14 @@ func main() {
 		softMaxMem,
 		hardMaxMem,
 		func(pct float64, b uint64) bool {
-			clears := int(float64(cache.Len()) * (pct + 0.02))
+			clears := uint64(float64(c.Usage().Bytes()) * (pct + 0.02))
+			freed := c.EvictBytes(clears)
 			logger.Printf(
-				"OOM: clearing %d random keys",
-				clears,
+				"OOM: evicted %dKiB of %dKiB (%s)",
+				freed/1024,
+				clears/1024,
+				*policyName,
 			)
-			cache.DelRand(clears)
 			return true
 		},
 	)
@@ -47,8 +478,14 @@ func main() {
 
 	go func() {
 		for {
-			cache.DelExpired()
-			cache.Clean()
+			c.DelExpired()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	go func() {
+		for {
+			c.Clean()
 			time.Sleep(time.Second * 10)
 		}
 	}()
@@ -60,20 +497,50 @@ func main() {
 		}
 	}()
 
-	serverLogger := log.New(ioutil.Discard, "", 0)
-	if *verbose {
-		serverLogger = logger
+	if *respAddr != "" {
+		r := resp.New(*respAddr, serverLogger, c, *respSep, *bodyMax*1024)
+		if *tokens != "" {
+			r.SetAuth(func(token, op, ns string, all bool) (bool, bool) {
+				return srv.Permits(token, server.Op(op), ns, all)
+			})
+		}
+		go serve(r.Start)
+		shutdown = append(shutdown, r.Shutdown)
 	}
 
-	logger.Println("Starting")
-	logger.Fatal(
-		server.New(
-			*addr,
-			serverLogger,
-			cache,
-			*bodyMax*1024,
-			time.Second*5,
-			time.Second,
-		).Start(),
-	)
+	if *mcAddr != "" {
+		m := memcache.New(*mcAddr, serverLogger, c, *mcNS, *bodyMax*1024)
+		go serve(m.Start)
+		shutdown = append(shutdown, m.Shutdown)
+	}
+
+	if *proxyAddr != "" {
+		px := proxy.New(*proxyAddr, serverLogger, c, upstream, *proxyNS, *bodyMax*1024)
+		go serve(px.Start)
+		shutdown = append(shutdown, px.Shutdown)
+	}
+
+	srv.SetReady(true)
+	logger.Println("Ready")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+	logger.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *drain)
+	for _, f := range shutdown {
+		if err := f(ctx); err != nil {
+			logger.Printf("Shutdown: %s", err)
+		}
+	}
+	cancel()
+
+	if *snapshot != "" {
+		save()
+		if j != nil {
+			if err := j.Close(); err != nil {
+				logger.Printf("Journal: %s", err)
+			}
+		}
+	}
 }
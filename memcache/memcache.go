@@ -0,0 +1,642 @@
+// Package memcache serves a cache.Cache over the memcached text protocol.
+//
+// All keys are stored in a single namespace, cas unique values are the
+// entry versions and item flags are stored with the entry.
+//
+// Supported commands: get gets set add replace append prepend cas delete
+// incr decr touch flush_all stats version verbosity quit.
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+// Version is reported by the version and stats commands.
+const Version = "1.6.0-webis"
+
+const (
+	maxKeyLen = 250
+	// relativeExpiry is the largest expiry in seconds that is relative,
+	// larger values are unix timestamps.
+	relativeExpiry = 60 * 60 * 24 * 30
+)
+
+// ErrServerClosed is returned by Start and Serve after Shutdown.
+var ErrServerClosed = errors.New("Server closed")
+
+type stats struct {
+	conns, totalConns            int64
+	gets, sets, touches, flushes int64
+	hits, misses                 int64
+}
+
+type Server struct {
+	// stats is first to keep its counters 64 bit aligned.
+	stats   stats
+	addr    string
+	l       *log.Logger
+	c       *cache.Cache
+	ns      string
+	maxItem int
+	started time.Time
+
+	sem    sync.Mutex
+	closed bool
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates a memcached server that stores keys in namespace ns,
+// maxItem limits the size of a single value.
+func New(
+	addr string,
+	l *log.Logger,
+	c *cache.Cache,
+	ns string,
+	maxItem int,
+) *Server {
+	return &Server{
+		addr:    addr,
+		l:       l,
+		c:       c,
+		ns:      ns,
+		maxItem: maxItem,
+		started: time.Now(),
+		lns:     make(map[net.Listener]struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown is called, after which it
+// returns ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			return err
+		}
+
+		go s.serve(c)
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish
+// their current command, connections still open when ctx is done are
+// closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.sem.Lock()
+	s.closed = true
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.conns {
+		// Interrupts idle connections waiting for a command.
+		c.SetReadDeadline(time.Now())
+	}
+	s.sem.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.sem.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.sem.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes ln from the listeners closed by Shutdown,
+// it returns false if the server is already shut down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if !add {
+		delete(s.lns, ln)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.lns[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes c from the connections Shutdown waits for,
+// it returns false if the server is already shut down.
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if !add {
+		delete(s.conns, c)
+		s.wg.Done()
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+type conn struct {
+	s *Server
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (s *Server) serve(c net.Conn) {
+	atomic.AddInt64(&s.stats.conns, 1)
+	atomic.AddInt64(&s.stats.totalConns, 1)
+	defer atomic.AddInt64(&s.stats.conns, -1)
+	defer c.Close()
+	if !s.trackConn(c, true) {
+		return
+	}
+	defer s.trackConn(c, false)
+
+	cn := &conn{s, bufio.NewReader(c), bufio.NewWriter(c)}
+	for {
+		line, err := cn.readLine()
+		if err != nil {
+			if err == errLineTooLong {
+				cn.w.WriteString("CLIENT_ERROR line too long\r\n")
+				cn.w.Flush()
+			} else if err != io.EOF && !s.isClosed() {
+				s.l.Println(err)
+			}
+			return
+		}
+
+		args := bytes.Fields(line)
+		if len(args) == 0 {
+			cn.reply("ERROR")
+		} else if quit := cn.exec(string(args[0]), args[1:]); quit {
+			cn.w.Flush()
+			return
+		}
+
+		// Flush once all pipelined commands are handled.
+		if cn.r.Buffered() == 0 {
+			if err := cn.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+var errLineTooLong = errors.New("Line too long")
+
+func (c *conn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, prefix, err := c.r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b...)
+		if len(line) > c.s.maxItem {
+			return nil, errLineTooLong
+		}
+		if !prefix {
+			return line, nil
+		}
+	}
+}
+
+func (c *conn) reply(s string) {
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) key(k []byte) cache.Key {
+	return cache.Key(c.s.ns + cache.NSSep + string(k))
+}
+
+func validKey(k []byte) bool {
+	if len(k) == 0 || len(k) > maxKeyLen {
+		return false
+	}
+	for _, b := range k {
+		if b <= ' ' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expires converts a memcached exptime to a time, 0 means never,
+// small values are relative in seconds, large ones unix timestamps and
+// negative ones have already expired.
+func expires(exptime int64) time.Time {
+	now := time.Now()
+	switch {
+	case exptime == 0:
+		return now.Add(1<<63 - 1)
+	case exptime < 0:
+		return now.Add(-time.Second)
+	case exptime <= relativeExpiry:
+		return now.Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+// exec handles a single command and reports whether the connection
+// should be closed.
+func (c *conn) exec(cmd string, args [][]byte) bool {
+	noreply := len(args) != 0 && string(args[len(args)-1]) == "noreply"
+	w := c.w
+	if noreply {
+		// Replies are still generated, just not written.
+		c.w = bufio.NewWriter(ioutil.Discard)
+		defer func() { c.w = w }()
+	}
+
+	switch cmd {
+	case "get", "gets":
+		c.get(args, cmd == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return c.store(cmd, args, noreply)
+	case "delete":
+		c.del(args)
+	case "incr", "decr":
+		c.incr(args, cmd == "decr")
+	case "touch":
+		c.touch(args)
+	case "flush_all":
+		c.flush(args)
+	case "stats":
+		c.statistics(args)
+	case "version":
+		c.reply("VERSION " + Version)
+	case "verbosity":
+		c.reply("OK")
+	case "quit":
+		return true
+	default:
+		c.reply("ERROR")
+	}
+
+	return false
+}
+
+func (c *conn) get(args [][]byte, cas bool) {
+	for _, k := range args {
+		atomic.AddInt64(&c.s.stats.gets, 1)
+		item, ok := c.s.c.GetItem(c.key(k))
+		if !ok {
+			atomic.AddInt64(&c.s.stats.misses, 1)
+			continue
+		}
+
+		atomic.AddInt64(&c.s.stats.hits, 1)
+		c.w.WriteString("VALUE ")
+		c.w.Write(k)
+		c.w.WriteByte(' ')
+		c.w.WriteString(strconv.FormatUint(uint64(item.Flags), 10))
+		c.w.WriteByte(' ')
+		c.w.WriteString(strconv.Itoa(len(item.Value)))
+		if cas {
+			c.w.WriteByte(' ')
+			c.w.WriteString(strconv.FormatUint(item.Version, 10))
+		}
+		c.w.WriteString("\r\n")
+		c.w.WriteString(item.Value)
+		c.w.WriteString("\r\n")
+	}
+	c.reply("END")
+}
+
+// store handles all storage commands:
+// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (c *conn) store(cmd string, args [][]byte, noreply bool) bool {
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != n {
+		c.reply("ERROR")
+		return false
+	}
+
+	flags, ferr := strconv.ParseUint(string(args[1]), 10, 32)
+	exptime, eerr := strconv.ParseInt(string(args[2]), 10, 64)
+	size, serr := strconv.Atoi(string(args[3]))
+	var unique uint64
+	var cerr error
+	if cmd == "cas" {
+		unique, cerr = strconv.ParseUint(string(args[4]), 10, 64)
+	}
+	if serr != nil || size < 0 {
+		// Without a valid size the data block can not be skipped.
+		c.reply("CLIENT_ERROR bad command line format")
+		return true
+	}
+
+	if size > c.s.maxItem {
+		if _, err := io.CopyN(ioutil.Discard, c.r, int64(size)+2); err != nil {
+			return true
+		}
+		c.reply("SERVER_ERROR object too large for cache")
+		return false
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return true
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		// Skip the rest of the oversized chunk.
+		if data[size+1] != '\n' {
+			if _, err := c.readLine(); err != nil {
+				return true
+			}
+		}
+		c.reply("CLIENT_ERROR bad data chunk")
+		return false
+	}
+
+	if !validKey(args[0]) || ferr != nil || eerr != nil || cerr != nil {
+		c.reply("CLIENT_ERROR bad command line format")
+		return false
+	}
+
+	atomic.AddInt64(&c.s.stats.sets, 1)
+	key := c.key(args[0])
+	item := cache.Item{
+		Value:   string(data[:size]),
+		Expires: expires(exptime),
+		Flags:   uint32(flags),
+	}
+
+	var err error
+	switch cmd {
+	case "set":
+		_, err = c.s.c.SetItem(key, item)
+	case "add":
+		_, err = c.s.c.CompareAndSetItem(key, item, 0)
+	case "cas":
+		if _, ok := c.s.c.GetItem(key); !ok {
+			c.reply("NOT_FOUND")
+			return false
+		}
+		if _, err = c.s.c.CompareAndSetItem(key, item, unique); err == cache.ErrVersion {
+			c.reply("EXISTS")
+			return false
+		}
+	default:
+		err = c.update(key, func(cur *cache.Item) bool {
+			switch cmd {
+			case "replace":
+				cur.Value, cur.Expires, cur.Flags = item.Value, item.Expires, item.Flags
+			case "append":
+				cur.Value += item.Value
+			case "prepend":
+				cur.Value = item.Value + cur.Value
+			}
+			return true
+		})
+	}
+
+	switch err {
+	case nil:
+		c.s.l.Printf("Create %s\t%dkB", key, size/1024)
+		c.reply("STORED")
+	case cache.ErrVersion, errNotFound:
+		c.reply("NOT_STORED")
+	default:
+		c.reply("SERVER_ERROR " + err.Error())
+	}
+
+	return false
+}
+
+var errNotFound = errors.New("Not found")
+
+// update atomically modifies an existing item, fn returns false to leave
+// it untouched.
+func (c *conn) update(key cache.Key, fn func(*cache.Item) bool) error {
+	for {
+		item, ok := c.s.c.GetItem(key)
+		if !ok {
+			return errNotFound
+		}
+
+		version := item.Version
+		if !fn(&item) {
+			return nil
+		}
+		_, err := c.s.c.CompareAndSetItem(key, item, version)
+		if err != cache.ErrVersion {
+			return err
+		}
+	}
+}
+
+func (c *conn) del(args [][]byte) {
+	if len(args) == 0 {
+		c.reply("ERROR")
+		return
+	}
+
+	key := c.key(args[0])
+	if !c.s.c.Del(key) {
+		c.reply("NOT_FOUND")
+		return
+	}
+	c.s.l.Printf("Delete %s", key)
+	c.reply("DELETED")
+}
+
+// incr implements memcached counters, which are unsigned 64 bit integers
+// that wrap around on incr and stop at 0 on decr.
+func (c *conn) incr(args [][]byte, decr bool) {
+	if len(args) < 2 {
+		c.reply("ERROR")
+		return
+	}
+
+	delta, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+
+	var n uint64
+	var numeric = true
+	err = c.update(c.key(args[0]), func(item *cache.Item) bool {
+		var perr error
+		if n, perr = strconv.ParseUint(item.Value, 10, 64); perr != nil {
+			numeric = false
+			return false
+		}
+
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		item.Value = strconv.FormatUint(n, 10)
+		return true
+	})
+
+	switch {
+	case err == errNotFound:
+		c.reply("NOT_FOUND")
+	case !numeric:
+		c.reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+	case err != nil:
+		c.reply("SERVER_ERROR " + err.Error())
+	default:
+		c.reply(strconv.FormatUint(n, 10))
+	}
+}
+
+func (c *conn) touch(args [][]byte) {
+	if len(args) < 2 {
+		c.reply("ERROR")
+		return
+	}
+
+	exptime, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		c.reply("CLIENT_ERROR invalid exptime argument")
+		return
+	}
+
+	atomic.AddInt64(&c.s.stats.touches, 1)
+	ok, err := c.s.c.Touch(c.key(args[0]), expires(exptime))
+	switch {
+	case err != nil:
+		c.reply("SERVER_ERROR " + err.Error())
+	case !ok:
+		c.reply("NOT_FOUND")
+	default:
+		c.reply("TOUCHED")
+	}
+}
+
+// flush purges the namespace, optionally after a delay in seconds.
+func (c *conn) flush(args [][]byte) {
+	delay := int64(0)
+	if len(args) != 0 && string(args[0]) != "noreply" {
+		var err error
+		if delay, err = strconv.ParseInt(string(args[0]), 10, 64); err != nil {
+			c.reply("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+
+	atomic.AddInt64(&c.s.stats.flushes, 1)
+	prefix := cache.Key(c.s.ns + cache.NSSep)
+	purge := func() {
+		c.s.l.Printf("Purge NS %s", c.s.ns)
+		c.s.c.DelByPrefix(prefix)
+	}
+
+	if delay > 0 {
+		time.AfterFunc(time.Duration(delay)*time.Second, purge)
+	} else {
+		purge()
+	}
+	c.reply("OK")
+}
+
+func (c *conn) statistics(args [][]byte) {
+	if len(args) != 0 {
+		// Sub statistics (items, slabs, ...) are not supported.
+		c.reply("END")
+		return
+	}
+
+	now := time.Now()
+	usage := c.s.c.NamespaceUsage(c.s.ns)
+	st := &c.s.stats
+	stat := func(name string, v interface{}) {
+		c.w.WriteString("STAT " + name + " ")
+		switch v := v.(type) {
+		case int64:
+			c.w.WriteString(strconv.FormatInt(v, 10))
+		case uint64:
+			c.w.WriteString(strconv.FormatUint(v, 10))
+		case string:
+			c.w.WriteString(v)
+		}
+		c.w.WriteString("\r\n")
+	}
+
+	stat("pid", int64(os.Getpid()))
+	stat("uptime", int64(now.Sub(c.s.started)/time.Second))
+	stat("time", now.Unix())
+	stat("version", Version)
+	stat("curr_connections", atomic.LoadInt64(&st.conns))
+	stat("total_connections", atomic.LoadInt64(&st.totalConns))
+	stat("cmd_get", atomic.LoadInt64(&st.gets))
+	stat("cmd_set", atomic.LoadInt64(&st.sets))
+	stat("cmd_touch", atomic.LoadInt64(&st.touches))
+	stat("cmd_flush", atomic.LoadInt64(&st.flushes))
+	stat("get_hits", atomic.LoadInt64(&st.hits))
+	stat("get_misses", atomic.LoadInt64(&st.misses))
+	stat("curr_items", int64(usage.Keys))
+	stat("bytes", usage.Bytes())
+	c.reply("END")
+}
@@ -0,0 +1,148 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+type client struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func newClient(t *testing.T, s *Server) *client {
+	a, b := net.Pipe()
+	go s.serve(b)
+	return &client{t, a, bufio.NewReader(a)}
+}
+
+// do sends a raw command and reads n reply lines joined by '|'.
+func (c *client) do(cmd string, n int) string {
+	go c.c.Write([]byte(cmd))
+	lines := make([]string, n)
+	for i := range lines {
+		l, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		lines[i] = strings.TrimSuffix(l, "\r\n")
+	}
+	return strings.Join(lines, "|")
+}
+
+func TestCommands(t *testing.T) {
+	s := New("", log.New(ioutil.Discard, "", 0), cache.New(), "mc", 1024)
+	c := newClient(t, s)
+	expect := func(reply, cmd string) {
+		t.Helper()
+		if r := c.do(cmd, strings.Count(reply, "|")+1); r != reply {
+			t.Fatalf("%q: expected '%s' got '%s'", cmd, reply, r)
+		}
+	}
+
+	expect("END", "get key\r\n")
+	expect("STORED", "set key 5 0 4\r\ndata\r\n")
+	expect("VALUE key 5 4|data|END", "get key missing\r\n")
+	if _, ok := s.c.Get(cache.Key("mc" + cache.NSSep + "key")); !ok {
+		t.Fatal("Expected key in namespace mc")
+	}
+
+	expect("NOT_STORED", "add key 0 0 1\r\nx\r\n")
+	expect("NOT_STORED", "replace other 0 0 1\r\nx\r\n")
+	expect("STORED", "append key 0 0 1\r\n!\r\n")
+	expect("STORED", "prepend key 0 0 1\r\n<\r\n")
+	expect("VALUE key 5 6|<data!|END", "get key\r\n")
+
+	item, _ := s.c.GetItem(cache.Key("mc" + cache.NSSep + "key"))
+	cas := "5 0 1 " + strconv.FormatUint(item.Version, 10)
+	expect("VALUE key 5 6 "+strconv.FormatUint(item.Version, 10)+"|<data!|END", "gets key\r\n")
+	expect("STORED", "cas key "+cas+"\r\nx\r\n")
+	expect("EXISTS", "cas key "+cas+"\r\nx\r\n")
+	expect("NOT_FOUND", "cas other "+cas+"\r\nx\r\n")
+
+	expect("STORED", "set n 0 0 2\r\n10\r\n")
+	expect("15", "incr n 5\r\n")
+	expect("0", "decr n 20\r\n")
+	expect("NOT_FOUND", "incr missing 1\r\n")
+	before, _ := s.c.GetItem(cache.Key("mc" + cache.NSSep + "key"))
+	expect("CLIENT_ERROR cannot increment or decrement non-numeric value", "incr key 1\r\n")
+	if after, _ := s.c.GetItem(cache.Key("mc" + cache.NSSep + "key")); after.Version != before.Version {
+		t.Fatalf("Failed incr changed the cas value from %d to %d", before.Version, after.Version)
+	}
+
+	expect("TOUCHED", "touch key 100\r\n")
+	expect("NOT_FOUND", "touch missing 100\r\n")
+	expect("DELETED", "delete key\r\n")
+	expect("NOT_FOUND", "delete key\r\n")
+
+	// noreply suppresses the reply, the following command still works.
+	expect("END", "set key 0 0 1 noreply\r\nx\r\ndelete key noreply\r\nget key\r\n")
+
+	expect("STORED", "set expired 0 -1 1\r\nx\r\n")
+	expect("END", "get expired\r\n")
+
+	expect("SERVER_ERROR object too large for cache", "set big 0 0 2000\r\n"+strings.Repeat("x", 2000)+"\r\n")
+	expect("CLIENT_ERROR bad data chunk", "set key 0 0 1\r\nxx\r\n")
+	expect("ERROR", "bogus\r\n")
+
+	s.c.Set("other", nil, "data", expires(0))
+	expect("OK", "flush_all\r\n")
+	expect("END", "get n\r\n")
+	if _, ok := s.c.Get("other"); !ok {
+		t.Fatal("flush_all purged another namespace")
+	}
+
+	if r := c.do("stats\r\n", 1); !strings.HasPrefix(r, "STAT pid ") {
+		t.Fatal(r)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := New("", log.New(ioutil.Discard, "", 0), cache.New(), "mc", 1024)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("version\r\n"))
+	if l, err := r.ReadString('\n'); err != nil || l != "VERSION "+Version+"\r\n" {
+		t.Fatalf("Unexpected reply '%s' %v", l, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Connection still open after shutdown: %v", err)
+	}
+	if err := s.Serve(ln); err != ErrServerClosed {
+		t.Fatalf("Serve after shutdown returned %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+// Package proxy serves a cache.Cache as a caching reverse proxy in front of
+// a single upstream.
+//
+// GET responses are stored when their Cache-Control allows a shared cache
+// to do so for a given time, s-maxage taking precedence over max-age.
+// They are tagged with the space separated Surrogate-Key and comma
+// separated Cache-Tag response headers so they can be purged by tag.
+// Responses with a Vary header are stored per value of the request headers
+// it names, those that vary on * are not stored.
+// All other requests are passed on as is.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+const (
+	// HeaderCache is set to HIT or MISS on cacheable responses.
+	HeaderCache = "X-Cache"
+
+	HeaderSurrogateKey = "Surrogate-Key"
+	HeaderCacheTag     = "Cache-Tag"
+)
+
+// cacheable are the status codes that may be stored, see RFC 7231 6.1.
+var cacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// metaVary is the item meta holding the Vary fields of a stored URI, its
+// responses are stored under variant keys.
+const metaVary = "Vary"
+
+type ctxKey struct{}
+
+// pending is the context value of a request whose response may be stored.
+type pending struct {
+	key    cache.Key
+	header http.Header
+}
+
+type Server struct {
+	addr    string
+	l       *log.Logger
+	c       *cache.Cache
+	ns      string
+	maxBody int
+	rp      *httputil.ReverseProxy
+	srv     *http.Server
+}
+
+// New creates a proxy to upstream that stores responses in namespace ns,
+// responses with a body larger than maxBody are passed on without storing.
+func New(
+	addr string,
+	l *log.Logger,
+	c *cache.Cache,
+	upstream *url.URL,
+	ns string,
+	maxBody int,
+) *Server {
+	s := &Server{addr: addr, l: l, c: c, ns: ns, maxBody: maxBody}
+	s.rp = httputil.NewSingleHostReverseProxy(upstream)
+	s.rp.ModifyResponse = s.store
+	s.rp.ErrorLog = l
+	s.srv = &http.Server{
+		Handler:           s,
+		MaxHeaderBytes:    1024 * 80,
+		ReadHeaderTimeout: time.Second * 5,
+	}
+	return s
+}
+
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown is called, after which it
+// returns http.ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.srv.Serve(ln)
+}
+
+// Shutdown gracefully stops the proxy, see http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Authorization") != "" {
+		s.rp.ServeHTTP(w, r)
+		return
+	}
+
+	key := cache.Key(s.ns + cache.NSSep + r.URL.RequestURI())
+	if v, ok := s.lookup(key, r.Header); ok {
+		res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(v)), r)
+		if err == nil {
+			s.hit(w, r, res)
+			return
+		}
+		s.l.Printf("Proxy: corrupt entry %s: %s", r.URL.RequestURI(), err)
+	}
+
+	if r.Method == "HEAD" {
+		s.rp.ServeHTTP(w, r)
+		return
+	}
+
+	// Only store complete responses, conditional requests might get a 304.
+	r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, pending{key, r.Header}))
+	r.Header = r.Header.Clone()
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	r.Header.Del("Range")
+	w.Header().Set(HeaderCache, "MISS")
+	s.rp.ServeHTTP(w, r)
+}
+
+// lookup returns the stored response for key, following its Vary fields to
+// the variant matching the request header h.
+func (s *Server) lookup(key cache.Key, h http.Header) (string, bool) {
+	item, ok := s.c.GetItem(key)
+	if !ok {
+		return "", false
+	}
+
+	vary, ok := item.Meta[metaVary]
+	if !ok {
+		return item.Value, true
+	}
+
+	return s.c.Get(variant(key, strings.Split(vary, ","), h))
+}
+
+func (s *Server) hit(w http.ResponseWriter, r *http.Request, res *http.Response) {
+	defer res.Body.Close()
+	h := w.Header()
+	for k, v := range res.Header {
+		h[k] = v
+	}
+	h.Set(HeaderCache, "HIT")
+	if date, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		h.Set("Age", strconv.Itoa(int(time.Since(date)/time.Second)))
+	}
+	w.WriteHeader(res.StatusCode)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		s.l.Println(err)
+	}
+}
+
+// store is the ReverseProxy.ModifyResponse hook, it stores res if it is
+// cacheable and small enough.
+func (s *Server) store(res *http.Response) error {
+	p, ok := res.Request.Context().Value(ctxKey{}).(pending)
+	if !ok || !cacheable[res.StatusCode] {
+		return nil
+	}
+
+	ttl, ok := sharedTTL(res.Header)
+	if !ok || res.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+
+	fields, ok := varyFields(res.Header)
+	if !ok {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(s.maxBody)+1))
+	if err != nil {
+		return err
+	}
+
+	if len(body) > s.maxBody {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return nil
+	}
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	tags := surrogateKeys(res.Header)
+	for i := range tags {
+		tags[i] = cache.Tag(s.ns + cache.NSSep + string(tags[i]))
+	}
+	res.Header.Del(HeaderSurrogateKey)
+	res.Header.Del(HeaderCacheTag)
+
+	stored := &http.Response{
+		StatusCode:    res.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        res.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	stored.Header.Del("Transfer-Encoding")
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(body)+512))
+	if err := stored.Write(buf); err != nil {
+		return err
+	}
+
+	key, expires := p.key, time.Now().Add(ttl)
+	if len(fields) != 0 {
+		vary := cache.Item{
+			Tags:    tags,
+			Expires: expires,
+			Meta:    map[string]string{metaVary: strings.Join(fields, ",")},
+		}
+		if _, err := s.c.SetItem(key, vary); err != nil {
+			s.l.Printf("Proxy: %s", err)
+			return nil
+		}
+		key = variant(key, fields, p.header)
+	}
+
+	if err := s.c.Set(key, tags, buf.String(), expires); err != nil {
+		s.l.Printf("Proxy: %s", err)
+		return nil
+	}
+
+	s.l.Printf("Proxy store %s\t%v\t%s", cleanKey(key), tags, ttl)
+	return nil
+}
+
+// sharedTTL returns how long a shared cache may store a response according
+// to its Cache-Control header.
+func sharedTTL(h http.Header) (time.Duration, bool) {
+	var maxAge, sMaxAge string
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			p := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			switch strings.ToLower(p[0]) {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				if len(p) == 2 {
+					maxAge = strings.Trim(p[1], `"`)
+				}
+			case "s-maxage":
+				if len(p) == 2 {
+					sMaxAge = strings.Trim(p[1], `"`)
+				}
+			}
+		}
+	}
+
+	if sMaxAge != "" {
+		maxAge = sMaxAge
+	}
+
+	n, err := strconv.ParseUint(maxAge, 10, 31)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// varyFields returns the sorted, canonical field names of the Vary header,
+// ok is false if the response varies on *.
+func varyFields(h http.Header) (fields []string, ok bool) {
+	seen := make(map[string]bool)
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			f = http.CanonicalHeaderKey(strings.TrimSpace(f))
+			switch {
+			case f == "*":
+				return nil, false
+			case f != "" && !seen[f]:
+				seen[f] = true
+				fields = append(fields, f)
+			}
+		}
+	}
+
+	sort.Strings(fields)
+	return fields, true
+}
+
+// variant returns the key of the response stored for the values of the
+// request header h named by fields.
+func variant(key cache.Key, fields []string, h http.Header) cache.Key {
+	v := make(url.Values, len(fields))
+	for _, f := range fields {
+		v[f] = h.Values(f)
+	}
+	return key + cache.Key(cache.NSSep+v.Encode())
+}
+
+func surrogateKeys(h http.Header) []cache.Tag {
+	var tags []cache.Tag
+	for _, v := range h[HeaderSurrogateKey] {
+		for _, t := range strings.Fields(v) {
+			tags = append(tags, cache.Tag(t))
+		}
+	}
+
+	for _, v := range h[HeaderCacheTag] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, cache.Tag(t))
+			}
+		}
+	}
+
+	return tags
+}
+
+func cleanKey(k cache.Key) string {
+	if i := strings.Index(string(k), cache.NSSep); i != -1 {
+		return string(k[i+len(cache.NSSep):])
+	}
+	return string(k)
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/frizinak/webis/cache"
+)
+
+func TestProxy(t *testing.T) {
+	hits := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/cached":
+			w.Header().Set("Cache-Control", "public, max-age=1, s-maxage=100")
+			w.Header().Set("Surrogate-Key", "a b")
+			w.Header().Set("Content-Type", "text/html")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=100")
+		case "/large":
+			w.Header().Set("Cache-Control", "s-maxage=100")
+			w.Write([]byte(strings.Repeat("x", 100)))
+			return
+		}
+		w.Write([]byte("body " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	c := cache.New()
+	s := httptest.NewServer(New("", log.New(ioutil.Discard, "", 0), c, u, "proxy", 50))
+	defer s.Close()
+
+	get := func(method, path, expectCache string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, s.URL+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if method == "GET" && path != "/large" && !strings.HasSuffix(string(body), strings.TrimSuffix(path, "?q")) {
+			t.Fatalf("%s: unexpected body '%s'", path, body)
+		}
+		if path == "/large" && len(body) != 100 {
+			t.Fatalf("Truncated body of %d bytes", len(body))
+		}
+		if v := res.Header.Get(HeaderCache); v != expectCache {
+			t.Fatalf("%s %s: expected %s '%s' got '%s'", method, path, HeaderCache, expectCache, v)
+		}
+		return res
+	}
+
+	get("GET", "/cached", "MISS")
+	res := get("GET", "/cached", "HIT")
+	get("HEAD", "/cached", "HIT")
+	if hits["/cached"] != 1 {
+		t.Fatalf("Upstream hit %d times", hits["/cached"])
+	}
+	if res.Header.Get("Content-Type") != "text/html" || res.Header.Get(HeaderSurrogateKey) != "" {
+		t.Fatalf("Unexpected headers %v", res.Header)
+	}
+
+	// The query is part of the key.
+	get("GET", "/cached?q", "MISS")
+
+	c.DelByTag(cache.Tag("proxy" + cache.NSSep + "b"))
+	get("GET", "/cached", "MISS")
+	if hits["/cached"] != 3 {
+		t.Fatalf("Upstream hit %d times after purge", hits["/cached"])
+	}
+
+	get("GET", "/private", "MISS")
+	get("GET", "/private", "MISS")
+	get("GET", "/large", "MISS")
+	get("GET", "/large", "MISS")
+
+	res, err := http.Post(s.URL+"/cached", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get(HeaderCache) != "" || hits["/cached"] != 4 {
+		t.Fatal("POST was not passed on")
+	}
+}
+
+func TestVary(t *testing.T) {
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "s-maxage=100")
+		w.Header().Set("Vary", "accept-language")
+		if r.URL.Path == "/any" {
+			w.Header().Add("Vary", "*")
+		}
+		w.Write([]byte("body " + r.Header.Get("Accept-Language")))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	s := httptest.NewServer(New("", log.New(ioutil.Discard, "", 0), cache.New(), u, "proxy", 50))
+	defer s.Close()
+
+	get := func(path, lang, expectCache string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", s.URL+path, nil)
+		req.Header.Set("Accept-Language", lang)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "body "+lang {
+			t.Fatalf("%s: unexpected body '%s'", lang, body)
+		}
+		if v := res.Header.Get(HeaderCache); v != expectCache {
+			t.Fatalf("%s: expected %s '%s' got '%s'", lang, HeaderCache, expectCache, v)
+		}
+	}
+
+	get("/", "nl", "MISS")
+	get("/", "en", "MISS")
+	get("/", "nl", "HIT")
+	get("/", "en", "HIT")
+	if hits != 2 {
+		t.Fatalf("Upstream hit %d times", hits)
+	}
+
+	get("/any", "nl", "MISS")
+	get("/any", "nl", "MISS")
+}
+
+func TestSharedTTL(t *testing.T) {
+	for v, expect := range map[string]int{
+		"max-age=10":                  10,
+		"max-age=10, s-maxage=20":     20,
+		`public, s-maxage="30"`:       30,
+		"no-store, s-maxage=20":       0,
+		"max-age=0":                   0,
+		"":                            0,
+		"S-MAXAGE=5, must-revalidate": 5,
+	} {
+		ttl, ok := sharedTTL(http.Header{"Cache-Control": {v}})
+		if int(ttl.Seconds()) != expect || ok != (expect != 0) {
+			t.Errorf("%s: got %s %v", v, ttl, ok)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package resp
+
+// match reports whether s matches the redis glob pattern, supporting
+// *, ?, [abc], [^a-z] and \ escapes.
+func match(p, s string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			if p == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(p, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if s == "" {
+				return false
+			}
+			p, s = p[1:], s[1:]
+			continue
+
+		case '[':
+			end := -1
+			for i := 2; i < len(p); i++ {
+				if p[i] == ']' {
+					end = i
+					break
+				}
+			}
+			if end == -1 {
+				break
+			}
+			if s == "" || !class(p[1:end], s[0]) {
+				return false
+			}
+			p, s = p[end+1:], s[1:]
+			continue
+
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+		}
+
+		if s == "" || p[0] != s[0] {
+			return false
+		}
+		p, s = p[1:], s[1:]
+	}
+
+	return s == ""
+}
+
+func class(c string, b byte) bool {
+	neg := len(c) > 1 && c[0] == '^'
+	if neg {
+		c = c[1:]
+	}
+
+	for i := 0; i < len(c); i++ {
+		if i+2 < len(c) && c[i+1] == '-' {
+			if b >= c[i] && b <= c[i+2] {
+				return !neg
+			}
+			i += 2
+			continue
+		}
+		if c[i] == b {
+			return !neg
+		}
+	}
+
+	return neg
+}
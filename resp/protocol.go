@@ -0,0 +1,137 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// maxArgs limits the amount of arguments a single command can have.
+const maxArgs = 1024 * 1024
+
+var (
+	errProtocol = errors.New("ERR Protocol error")
+	errTooLarge = errors.New("ERR Protocol error: too large")
+)
+
+// readCommand reads either a RESP array of bulk strings or an inline
+// command, bulk strings are limited to max bytes.
+func readCommand(r *bufio.Reader, max int) ([]string, error) {
+	line, err := readLine(r, max)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		fields := bytes.Fields(line)
+		args := make([]string, len(fields))
+		for i := range fields {
+			args[i] = string(fields[i])
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, errProtocol
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, max)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+
+		l, err := strconv.Atoi(string(line[1:]))
+		if err != nil || l < 0 {
+			return nil, errProtocol
+		}
+		if l > max {
+			return nil, errTooLarge
+		}
+
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[l] != '\r' || b[l+1] != '\n' {
+			return nil, errProtocol
+		}
+
+		args = append(args, string(b[:l]))
+	}
+
+	return args, nil
+}
+
+// readLine reads a single CRLF (or LF) terminated line.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		b, prefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b...)
+		if len(line) > max {
+			return nil, errTooLarge
+		}
+		if !prefix {
+			return line, nil
+		}
+	}
+}
+
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w writer) error(s string) {
+	w.WriteByte('-')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
+
+func (w writer) bulk(s string) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(s)))
+	w.WriteString("\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
+
+func (w writer) strings(l []string) {
+	w.array(len(l))
+	for _, s := range l {
+		w.bulk(s)
+	}
+}
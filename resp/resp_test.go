@@ -0,0 +1,283 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+type client struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func newClient(t *testing.T, s *Server) *client {
+	a, b := net.Pipe()
+	go s.serve(b)
+	return &client{t, a, bufio.NewReader(a)}
+}
+
+// do sends a command and returns its reply, arrays are formatted as [a b].
+func (c *client) do(args ...string) string {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	go c.c.Write([]byte(cmd))
+	return c.reply()
+}
+
+func (c *client) line() string {
+	l, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(l, "\r\n")
+}
+
+func (c *client) reply() string {
+	l := c.line()
+	switch l[0] {
+	case '$':
+		if l == "$-1" {
+			return l
+		}
+		return c.line()
+	case '*':
+		var n int
+		fmt.Sscanf(l[1:], "%d", &n)
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = c.reply()
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return l
+}
+
+func newServer(sep string) *Server {
+	return New("", log.New(ioutil.Discard, "", 0), cache.New(), sep, 1024)
+}
+
+func TestCommands(t *testing.T) {
+	s := newServer("")
+	c := newClient(t, s)
+	expect := func(reply string, args ...string) {
+		t.Helper()
+		if r := c.do(args...); r != reply {
+			t.Fatalf("%v: expected '%s' got '%s'", args, reply, r)
+		}
+	}
+
+	expect("+PONG", "PING")
+	expect("$-1", "GET", "key")
+	expect("+OK", "SET", "key", "value", "EX", "100", "TAG", "tag")
+	expect("value", "GET", "key")
+	expect("$-1", "SET", "key", "other", "NX")
+	expect("+OK", "SET", "key", "value", "XX", "TAG", "tag")
+	expect("$-1", "SET", "missing", "value", "XX")
+	expect(":-1", "TTL", "key")
+	expect(":-2", "TTL", "missing")
+	expect(":1", "EXPIRE", "key", "100")
+	expect(":100", "TTL", "key")
+	expect(":1", "PERSIST", "key")
+	expect(":-1", "TTL", "key")
+
+	expect(":11", "INCRBY", "counter", "11")
+	expect(":10", "DECR", "counter")
+	expect("-ERR value is not an integer or out of range", "INCR", "key")
+
+	expect("+OK", "MSET", "a", "1", "b", "2")
+	expect("[1 $-1 2]", "MGET", "a", "x", "b")
+	expect("[a]", "KEYS", "[a]")
+	expect("[tag]", "TAG.LIST", "key")
+	expect("[key]", "TAG.KEYS", "tag")
+	expect("+OK", "TAG.DEL", "tag")
+	expect(":0", "EXISTS", "key")
+	expect(":2", "DEL", "a", "b", "x")
+
+	expect("+OK", "SELECT", "1")
+	expect("$-1", "GET", "counter")
+	expect("+OK", "SET", "counter", "1")
+	expect(":1", "DBSIZE")
+	expect("+OK", "FLUSHDB")
+	expect(":0", "DBSIZE")
+	expect("+OK", "SELECT", "0")
+	expect("10", "GET", "counter")
+
+	expect("-ERR wrong number of arguments for 'get' command", "GET")
+	expect("-ERR unknown command 'nope'", "nope")
+
+	// Negative lengths close the connection.
+	go c.c.Write([]byte("*-1\r\n"))
+	if r := c.reply(); r != "-"+errProtocol.Error() {
+		t.Fatalf("*-1: expected a protocol error got '%s'", r)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	s := newServer(":")
+	c := newClient(t, s)
+	c.do("SET", "ns:key", "value")
+	if _, ok := s.c.Get(cache.Key("ns" + cache.NSSep + "key")); !ok {
+		t.Fatal("Expected key in namespace ns")
+	}
+
+	if r := c.do("KEYS", "ns:*"); r != "[ns:key]" {
+		t.Fatal(r)
+	}
+
+	c.do("SELECT", "ns")
+	if r := c.do("GET", "key"); r != "value" {
+		t.Fatal(r)
+	}
+}
+
+func TestScan(t *testing.T) {
+	s := newServer("")
+	c := newClient(t, s)
+	for i := 0; i < 100; i++ {
+		c.do("SET", fmt.Sprintf("key%d", i), "v")
+	}
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		r := c.do("SCAN", cursor, "MATCH", "key*", "COUNT", "7")
+		parts := strings.Fields(strings.Trim(r, "[]"))
+		cursor = parts[0]
+		for _, k := range parts[1:] {
+			if seen[k] {
+				t.Fatalf("Scanned %s twice", k)
+			}
+			seen[k] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if len(seen) != 100 {
+		t.Fatalf("Scanned %d of 100 keys", len(seen))
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := newServer(":")
+	s.SetAuth(func(token, op, ns string, all bool) (bool, bool) {
+		switch token {
+		case "app":
+			return true, !all && ns == "app" && (op == opRead || op == opWrite)
+		case "admin":
+			return true, true
+		}
+		return false, false
+	})
+
+	c := newClient(t, s)
+	expect := func(reply string, args ...string) {
+		t.Helper()
+		if r := c.do(args...); r != reply {
+			t.Fatalf("%v: expected '%s' got '%s'", args, reply, r)
+		}
+	}
+
+	expect("-NOAUTH Authentication required.", "PING")
+	expect("-NOAUTH Authentication required.", "FLUSHALL")
+	expect("-WRONGPASS invalid token", "AUTH", "wrong")
+	expect("-NOAUTH Authentication required.", "GET", "app:key")
+	expect("+OK", "AUTH", "user", "app")
+	expect("+PONG", "PING")
+	expect("+OK", "SET", "app:key", "v", "EX", "100", "TAG", "app:tag")
+	expect("-NOPERM this token has no permissions to run this command", "SET", "app:key", "v", "TAG", "other:tag")
+	expect("$-1", "GET", "app:other")
+	expect("-NOPERM this token has no permissions to run this command", "GET", "key")
+	expect("-NOPERM this token has no permissions to run this command", "MGET", "app:key", "other:key")
+	expect("-NOPERM this token has no permissions to run this command", "MSET", "app:a", "1", "b", "2")
+	expect("-NOPERM this token has no permissions to run this command", "DEL", "app:key")
+	expect("-NOPERM this token has no permissions to run this command", "SCAN", "0", "MATCH", "other:*")
+	expect("-NOPERM this token has no permissions to run this command", "SCAN", "0", "MATCH", "app:*", "MATCH", "other:*")
+	expect("-NOPERM this token has no permissions to run this command", "FLUSHALL")
+	expect("+OK", "SELECT", "app")
+	expect(":1", "DBSIZE")
+	expect("-NOPERM this token has no permissions to run this command", "FLUSHDB")
+	expect("+OK", "AUTH", "admin")
+	expect("+OK", "FLUSHALL")
+	expect(":0", "DBSIZE")
+
+	if r := newClient(t, newServer("")).do("AUTH", "token"); !strings.HasPrefix(r, "-ERR") {
+		t.Fatalf("AUTH without tokens: '%s'", r)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newServer("")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("PING\r\n"))
+	if l, err := r.ReadString('\n'); err != nil || l != "+PONG\r\n" {
+		t.Fatalf("Unexpected reply '%s' %v", l, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errc; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Connection still open after shutdown: %v", err)
+	}
+	if err := s.Serve(ln); err != ErrServerClosed {
+		t.Fatalf("Serve after shutdown returned %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		p, s string
+		ok   bool
+	}{
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"key", "key2", false},
+	}
+
+	for _, test := range tests {
+		if match(test.p, test.s) != test.ok {
+			t.Errorf("%s %s: expected %v", test.p, test.s, test.ok)
+		}
+	}
+}
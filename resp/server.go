@@ -0,0 +1,856 @@
+// Package resp serves a cache.Cache over the Redis protocol (RESP2).
+//
+// Namespaces are selected with SELECT <namespace>, where 0 is the default
+// namespace, or when a key separator is configured, by prefixing keys
+// with <namespace><separator>.
+//
+// Supported commands: AUTH PING ECHO SELECT QUIT COMMAND CLIENT GET SET
+// SETEX SETNX MGET MSET DEL UNLINK EXISTS EXPIRE PEXPIRE PERSIST TTL PTTL
+// INCR DECR INCRBY DECRBY KEYS SCAN DBSIZE FLUSHDB FLUSHALL.
+//
+// When authentication is enabled with SetAuth, connections have to
+// AUTH <token> first and every command is checked against the namespaces
+// of its keys.
+//
+// Unlike Redis, MSET is not atomic: when a pair exceeds the namespace quota
+// the pairs before it remain set.
+//
+// Tags are supported through the non-standard SET option TAG <tag>, which
+// can be repeated, and the commands:
+//
+// TAG.KEYS <tag>          keys of a tag
+// TAG.DEL <tag> [tag...]  delete all keys of the given tags
+// TAG.LIST <key>          tags of a key
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+// forever is the remaining ttl above which an entry is considered
+// to never expire, it matches the max ttl of the http server.
+const forever = time.Duration(math.MaxInt32) * time.Second
+
+// ErrServerClosed is returned by Start and Serve after Shutdown.
+var ErrServerClosed = errors.New("Server closed")
+
+// Operations passed to the Auth func, they match those of server.Op.
+const (
+	opRead     = "read"
+	opWrite    = "write"
+	opDelete   = "delete"
+	opPurge    = "purge"
+	opPurgeAll = "purge-all"
+)
+
+// Auth reports whether token is known and whether it permits op on
+// namespace ns, or on all namespaces if all is true.
+type Auth func(token, op, ns string, all bool) (known, permitted bool)
+
+type Server struct {
+	addr    string
+	l       *log.Logger
+	c       *cache.Cache
+	sep     string
+	maxBulk int
+	auth    Auth
+
+	sem    sync.Mutex
+	closed bool
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates a RESP server, sep is the namespace separator in keys, an
+// empty sep disables namespace prefixes. maxBulk limits the size of a
+// single argument.
+func New(
+	addr string,
+	l *log.Logger,
+	c *cache.Cache,
+	sep string,
+	maxBulk int,
+) *Server {
+	return &Server{
+		addr:    addr,
+		l:       l,
+		c:       c,
+		sep:     sep,
+		maxBulk: maxBulk,
+		lns:     make(map[net.Listener]struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// SetAuth requires clients to authenticate with a token, it should be
+// called before Start or Serve.
+func (s *Server) SetAuth(auth Auth) {
+	s.auth = auth
+}
+
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown is called, after which it
+// returns ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			return err
+		}
+
+		go s.serve(c)
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish
+// their current command, connections still open when ctx is done are
+// closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.sem.Lock()
+	s.closed = true
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.conns {
+		// Interrupts idle connections waiting for a command.
+		c.SetReadDeadline(time.Now())
+	}
+	s.sem.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.sem.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.sem.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes ln from the listeners closed by Shutdown,
+// it returns false if the server is already shut down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if !add {
+		delete(s.lns, ln)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.lns[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes c from the connections Shutdown waits for,
+// it returns false if the server is already shut down.
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	if !add {
+		delete(s.conns, c)
+		s.wg.Done()
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+type conn struct {
+	s     *Server
+	ns    string
+	w     writer
+	token string
+	authd bool
+}
+
+func (s *Server) serve(c net.Conn) {
+	defer c.Close()
+	if !s.trackConn(c, true) {
+		return
+	}
+	defer s.trackConn(c, false)
+
+	r := bufio.NewReader(c)
+	cn := &conn{s: s, w: writer{bufio.NewWriter(c)}}
+	for {
+		args, err := readCommand(r, s.maxBulk)
+		if err != nil {
+			if err == errProtocol || err == errTooLarge {
+				cn.w.error(err.Error())
+				cn.w.Flush()
+			} else if err != io.EOF && !s.isClosed() {
+				s.l.Println(err)
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := strings.ToUpper(args[0]) == "QUIT"
+		cn.exec(args)
+
+		// Flush once all pipelined commands are handled.
+		if r.Buffered() == 0 || quit {
+			if err := cn.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) exec(args []string) {
+	cmd := strings.ToUpper(args[0])
+	h, ok := commands[cmd]
+	if !ok {
+		c.w.error("ERR unknown command '" + args[0] + "'")
+		return
+	}
+
+	if n := len(args) - 1; n < h.min || (h.max >= 0 && n > h.max) {
+		c.w.error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+		return
+	}
+
+	if c.s.auth != nil && cmd != "AUTH" && cmd != "QUIT" && !c.permitted(h, args[1:]) {
+		return
+	}
+
+	h.fn(c, cmd, args[1:])
+}
+
+// permitted checks whether the connection's token allows command h on the
+// namespaces of its keys and writes an error if not.
+func (c *conn) permitted(h command, args []string) bool {
+	if !c.authd {
+		c.w.error("NOAUTH Authentication required.")
+		return false
+	}
+
+	if h.op == "" {
+		return true
+	}
+
+	var keys []string
+	if h.keys != nil {
+		keys = h.keys(args)
+	}
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+
+	for _, k := range keys {
+		ns, _ := c.split(k)
+		known, permitted := c.s.auth(c.token, h.op, ns, h.op == opPurgeAll)
+		if !known {
+			c.authd = false
+			c.w.error("NOAUTH Authentication required.")
+			return false
+		}
+		if !permitted {
+			c.w.error("NOPERM this token has no permissions to run this command")
+			return false
+		}
+	}
+
+	return true
+}
+
+// command is a handler that takes between min and max arguments, -1 being
+// unlimited. Its keys are checked for permission to perform op, commands
+// without keys are checked against the selected namespace and those
+// without op only require authentication.
+type command struct {
+	min, max int
+	op       string
+	keys     func(args []string) []string
+	fn       func(c *conn, cmd string, args []string)
+}
+
+func firstKey(a []string) []string { return a[:1] }
+func allKeys(a []string) []string  { return a }
+
+// pairKeys returns the keys of key value pairs.
+func pairKeys(a []string) []string {
+	keys := make([]string, 0, len(a)/2)
+	for i := 0; i < len(a); i += 2 {
+		keys = append(keys, a[i])
+	}
+	return keys
+}
+
+// setKeys returns the key and TAG options of SET, tags are written to the
+// tag index of their namespace.
+func setKeys(a []string) []string {
+	keys := []string{a[0]}
+	for i := 2; i+1 < len(a); i++ {
+		switch strings.ToUpper(a[i]) {
+		case "TAG":
+			keys = append(keys, a[i+1])
+			i++
+		case "EX", "PX":
+			i++
+		}
+	}
+	return keys
+}
+
+// matchKey returns the MATCH pattern of SCAN.
+func matchKey(a []string) []string {
+	pattern, _, err := scanOptions(a)
+	if err != nil {
+		return nil
+	}
+	return []string{pattern}
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"AUTH":     {1, 2, "", nil, (*conn).authenticate},
+		"PING":     {0, 1, "", nil, (*conn).ping},
+		"ECHO":     {1, 1, "", nil, func(c *conn, cmd string, a []string) { c.w.bulk(a[0]) }},
+		"QUIT":     {0, 0, "", nil, func(c *conn, cmd string, a []string) { c.w.simple("OK") }},
+		"SELECT":   {1, 1, "", nil, (*conn).sel},
+		"COMMAND":  {0, -1, "", nil, func(c *conn, cmd string, a []string) { c.w.array(0) }},
+		"CLIENT":   {1, -1, "", nil, func(c *conn, cmd string, a []string) { c.w.simple("OK") }},
+		"GET":      {1, 1, opRead, firstKey, (*conn).get},
+		"SET":      {2, -1, opWrite, setKeys, (*conn).set},
+		"SETEX":    {3, 3, opWrite, firstKey, (*conn).setex},
+		"SETNX":    {2, 2, opWrite, firstKey, (*conn).setnx},
+		"MGET":     {1, -1, opRead, allKeys, (*conn).mget},
+		"MSET":     {2, -1, opWrite, pairKeys, (*conn).mset},
+		"DEL":      {1, -1, opDelete, allKeys, (*conn).del},
+		"UNLINK":   {1, -1, opDelete, allKeys, (*conn).del},
+		"EXISTS":   {1, -1, opRead, allKeys, (*conn).exists},
+		"EXPIRE":   {2, 2, opWrite, firstKey, (*conn).expire},
+		"PEXPIRE":  {2, 2, opWrite, firstKey, (*conn).expire},
+		"PERSIST":  {1, 1, opWrite, firstKey, (*conn).persist},
+		"TTL":      {1, 1, opRead, firstKey, (*conn).ttl},
+		"PTTL":     {1, 1, opRead, firstKey, (*conn).ttl},
+		"INCR":     {1, 1, opWrite, firstKey, (*conn).incr},
+		"DECR":     {1, 1, opWrite, firstKey, (*conn).incr},
+		"INCRBY":   {2, 2, opWrite, firstKey, (*conn).incr},
+		"DECRBY":   {2, 2, opWrite, firstKey, (*conn).incr},
+		"KEYS":     {1, 1, opRead, firstKey, (*conn).keys},
+		"SCAN":     {1, -1, opRead, matchKey, (*conn).scan},
+		"DBSIZE":   {0, 0, opRead, nil, (*conn).dbsize},
+		"FLUSHDB":  {0, 1, opPurge, nil, (*conn).flushdb},
+		"FLUSHALL": {0, 1, opPurgeAll, nil, (*conn).flushall},
+		"TAG.KEYS": {1, 1, opRead, firstKey, (*conn).tagKeys},
+		"TAG.DEL":  {1, -1, opDelete, allKeys, (*conn).tagDel},
+		"TAG.LIST": {1, 1, opRead, firstKey, (*conn).tagList},
+	}
+}
+
+// split returns the namespace and key of a client key.
+func (c *conn) split(k string) (string, string) {
+	if c.s.sep != "" {
+		if i := strings.Index(k, c.s.sep); i != -1 {
+			return k[:i], k[i+len(c.s.sep):]
+		}
+	}
+	return c.ns, k
+}
+
+func (c *conn) key(k string) cache.Key {
+	ns, k := c.split(k)
+	return cache.Key(ns + cache.NSSep + k)
+}
+
+func (c *conn) tag(t string) cache.Tag {
+	ns, t := c.split(t)
+	return cache.Tag(ns + cache.NSSep + t)
+}
+
+// name converts a namespaced key or tag back to what the client uses.
+func (c *conn) name(k string) string {
+	i := strings.Index(k, cache.NSSep)
+	if i == -1 {
+		return k
+	}
+
+	ns, k := k[:i], k[i+len(cache.NSSep):]
+	if ns == c.ns || c.s.sep == "" {
+		return k
+	}
+	return ns + c.s.sep + k
+}
+
+func (c *conn) cacheError(err error) {
+	switch err {
+	case cache.ErrNotInteger:
+		c.w.error("ERR value is not an integer or out of range")
+	case cache.ErrOverflow:
+		c.w.error("ERR increment or decrement would overflow")
+	case cache.ErrQuota:
+		c.w.error("OOM " + err.Error())
+	default:
+		c.w.error("ERR " + err.Error())
+	}
+}
+
+// authenticate implements AUTH [<username>] <token>, the username is
+// ignored.
+func (c *conn) authenticate(cmd string, a []string) {
+	if c.s.auth == nil {
+		c.w.error("ERR AUTH called without any tokens configured")
+		return
+	}
+
+	token := a[len(a)-1]
+	if known, _ := c.s.auth(token, "", "", false); !known {
+		c.authd = false
+		c.w.error("WRONGPASS invalid token")
+		return
+	}
+
+	c.token, c.authd = token, true
+	c.w.simple("OK")
+}
+
+func (c *conn) ping(cmd string, a []string) {
+	if len(a) == 1 {
+		c.w.bulk(a[0])
+		return
+	}
+	c.w.simple("PONG")
+}
+
+func (c *conn) sel(cmd string, a []string) {
+	c.ns = a[0]
+	if c.ns == "0" {
+		c.ns = ""
+	}
+	c.w.simple("OK")
+}
+
+func (c *conn) get(cmd string, a []string) {
+	v, ok := c.s.c.Get(c.key(a[0]))
+	if !ok {
+		c.w.null()
+		return
+	}
+	c.w.bulk(v)
+}
+
+func (c *conn) set(cmd string, a []string) {
+	key, value := c.key(a[0]), a[1]
+	ttl := time.Duration(math.MaxInt64)
+	var tags []cache.Tag
+	var nx, xx bool
+	for i := 2; i < len(a); i++ {
+		opt := strings.ToUpper(a[i])
+		switch {
+		case opt == "NX":
+			nx = true
+		case opt == "XX":
+			xx = true
+		case (opt == "EX" || opt == "PX") && i+1 < len(a):
+			n, err := strconv.ParseInt(a[i+1], 10, 64)
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if err != nil || n <= 0 || time.Duration(n) > forever/unit {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		case opt == "TAG" && i+1 < len(a):
+			tags = append(tags, c.tag(a[i+1]))
+			i++
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+
+	if nx && xx {
+		c.w.error("ERR syntax error")
+		return
+	}
+
+	expires := time.Now().Add(ttl)
+	var err error
+	switch {
+	case nx:
+		_, err = c.s.c.CompareAndSet(key, tags, value, expires, 0)
+	case xx:
+		for {
+			item, ok := c.s.c.GetItem(key)
+			if !ok {
+				c.w.null()
+				return
+			}
+			_, err = c.s.c.CompareAndSet(key, tags, value, expires, item.Version)
+			if err != cache.ErrVersion {
+				break
+			}
+		}
+	default:
+		err = c.s.c.Set(key, tags, value, expires)
+	}
+
+	if err == cache.ErrVersion {
+		c.w.null()
+		return
+	}
+	if err != nil {
+		c.cacheError(err)
+		return
+	}
+
+	c.s.l.Printf("Create %s\t%v\t%dkB", key, tags, len(value)/1024)
+	c.w.simple("OK")
+}
+
+func (c *conn) setex(cmd string, a []string) {
+	c.set(cmd, []string{a[0], a[2], "EX", a[1]})
+}
+
+func (c *conn) setnx(cmd string, a []string) {
+	_, err := c.s.c.CompareAndSet(c.key(a[0]), nil, a[1], time.Now().Add(math.MaxInt64), 0)
+	switch err {
+	case nil:
+		c.w.integer(1)
+	case cache.ErrVersion:
+		c.w.integer(0)
+	default:
+		c.cacheError(err)
+	}
+}
+
+func (c *conn) mget(cmd string, a []string) {
+	c.w.array(len(a))
+	for _, k := range a {
+		c.get(cmd, []string{k})
+	}
+}
+
+func (c *conn) mset(cmd string, a []string) {
+	if len(a)%2 != 0 {
+		c.w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	expires := time.Now().Add(math.MaxInt64)
+	for i := 0; i < len(a); i += 2 {
+		if err := c.s.c.Set(c.key(a[i]), nil, a[i+1], expires); err != nil {
+			c.cacheError(err)
+			return
+		}
+	}
+	c.w.simple("OK")
+}
+
+func (c *conn) del(cmd string, a []string) {
+	n := int64(0)
+	for _, k := range a {
+		if c.s.c.Del(c.key(k)) {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+func (c *conn) exists(cmd string, a []string) {
+	n := int64(0)
+	for _, k := range a {
+		if _, ok := c.s.c.Get(c.key(k)); ok {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+func (c *conn) expire(cmd string, a []string) {
+	n, err := strconv.ParseInt(a[1], 10, 64)
+	unit := time.Second
+	if cmd == "PEXPIRE" {
+		unit = time.Millisecond
+	}
+	if err != nil || time.Duration(n) > forever/unit {
+		c.w.error("ERR value is not an integer or out of range")
+		return
+	}
+
+	key := c.key(a[0])
+	if n <= 0 {
+		if c.s.c.Del(key) {
+			c.w.integer(1)
+			return
+		}
+		c.w.integer(0)
+		return
+	}
+
+	ok, err := c.s.c.Touch(key, time.Now().Add(time.Duration(n)*unit))
+	if err != nil {
+		c.cacheError(err)
+		return
+	}
+	if !ok {
+		c.w.integer(0)
+		return
+	}
+	c.w.integer(1)
+}
+
+func (c *conn) persist(cmd string, a []string) {
+	key := c.key(a[0])
+	item, ok := c.s.c.GetItem(key)
+	if !ok || time.Until(item.Expires) > forever {
+		c.w.integer(0)
+		return
+	}
+
+	if ok, err := c.s.c.Touch(key, time.Now().Add(math.MaxInt64)); err != nil {
+		c.cacheError(err)
+		return
+	} else if !ok {
+		c.w.integer(0)
+		return
+	}
+	c.w.integer(1)
+}
+
+func (c *conn) ttl(cmd string, a []string) {
+	item, ok := c.s.c.GetItem(c.key(a[0]))
+	if !ok {
+		c.w.integer(-2)
+		return
+	}
+
+	ttl := time.Until(item.Expires)
+	switch {
+	case ttl > forever:
+		c.w.integer(-1)
+	case cmd == "PTTL":
+		c.w.integer(int64(ttl / time.Millisecond))
+	default:
+		c.w.integer(int64((ttl + time.Second/2) / time.Second))
+	}
+}
+
+func (c *conn) incr(cmd string, a []string) {
+	delta := int64(1)
+	if len(a) == 2 {
+		var err error
+		if delta, err = strconv.ParseInt(a[1], 10, 64); err != nil {
+			c.w.error("ERR value is not an integer or out of range")
+			return
+		}
+	}
+
+	if cmd == "DECR" || cmd == "DECRBY" {
+		if delta == math.MinInt64 {
+			c.w.error("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+
+	key := c.key(a[0])
+	n, err := c.s.c.Incr(key, nil, delta, 0, time.Now().Add(math.MaxInt64))
+	if err != nil {
+		c.cacheError(err)
+		return
+	}
+	c.w.integer(n)
+}
+
+func (c *conn) keys(cmd string, a []string) {
+	var l []string
+	c.match(a[0], func(k string) { l = append(l, k) })
+	c.w.strings(l)
+}
+
+// match calls cb with the client name of every key matching pattern.
+func (c *conn) match(pattern string, cb func(string)) {
+	ns, pattern := c.split(pattern)
+	prefix := cache.Key(ns + cache.NSSep)
+	c.s.c.IterateKeys(func(k cache.Key) bool {
+		if strings.HasPrefix(string(k), string(prefix)) &&
+			match(pattern, string(k[len(prefix):])) {
+			cb(c.name(string(k)))
+		}
+		return true
+	})
+}
+
+// scan uses the index of the next shard as cursor and returns whole
+// shards until at least count keys are found. Keys never move between
+// shards so those that exist during the entire iteration are returned
+// exactly once, and a full iteration visits every key once.
+func (c *conn) scan(cmd string, a []string) {
+	cursor, err := strconv.ParseUint(a[0], 10, 32)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+
+	pattern, count, err := scanOptions(a)
+	if err != nil {
+		c.w.error(err.Error())
+		return
+	}
+
+	ns, pattern := c.split(pattern)
+	prefix := len(ns) + len(cache.NSSep)
+	shard, shards := int(cursor), c.s.c.Shards()
+	var l []string
+	for ; shard < shards && len(l) < count; shard++ {
+		c.s.c.IterateShardKeys(shard, ns, func(k cache.Key) bool {
+			if match(pattern, string(k[prefix:])) {
+				l = append(l, c.name(string(k)))
+			}
+			return true
+		})
+	}
+
+	next := shard
+	if next >= shards {
+		next = 0
+	}
+
+	c.w.array(2)
+	c.w.bulk(strconv.Itoa(next))
+	c.w.strings(l)
+}
+
+var errSyntax = errors.New("ERR syntax error")
+
+// scanOptions parses the MATCH, COUNT and TYPE options following the SCAN
+// cursor, the last of a repeated option wins.
+func scanOptions(a []string) (pattern string, count int, err error) {
+	pattern, count = "*", 10
+	for i := 1; i < len(a); i += 2 {
+		if i+1 >= len(a) {
+			return "", 0, errSyntax
+		}
+
+		switch strings.ToUpper(a[i]) {
+		case "MATCH":
+			pattern = a[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(a[i+1]); err != nil || count < 1 {
+				return "", 0, errSyntax
+			}
+		case "TYPE":
+		default:
+			return "", 0, errSyntax
+		}
+	}
+
+	return pattern, count, nil
+}
+
+func (c *conn) dbsize(cmd string, a []string) {
+	c.w.integer(int64(c.s.c.NamespaceUsage(c.ns).Keys))
+}
+
+func (c *conn) flushdb(cmd string, a []string) {
+	c.s.l.Printf("Purge NS %s", c.ns)
+	c.s.c.DelByPrefix(cache.Key(c.ns + cache.NSSep))
+	c.w.simple("OK")
+}
+
+func (c *conn) flushall(cmd string, a []string) {
+	c.s.l.Printf("Purge ALL")
+	c.s.c.DelAll()
+	c.w.simple("OK")
+}
+
+func (c *conn) tagKeys(cmd string, a []string) {
+	keys := c.s.c.GetTagKeys(c.tag(a[0]))
+	l := make([]string, len(keys))
+	for i := range keys {
+		l[i] = c.name(string(keys[i]))
+	}
+	sort.Strings(l)
+	c.w.strings(l)
+}
+
+func (c *conn) tagDel(cmd string, a []string) {
+	for _, t := range a {
+		tag := c.tag(t)
+		c.s.c.DelByTag(tag)
+		c.s.l.Printf("Delete tag %s", tag)
+	}
+	c.w.simple("OK")
+}
+
+func (c *conn) tagList(cmd string, a []string) {
+	item, ok := c.s.c.GetItem(c.key(a[0]))
+	if !ok {
+		c.w.array(0)
+		return
+	}
+
+	l := make([]string, len(item.Tags))
+	for i := range item.Tags {
+		l[i] = c.name(string(item.Tags[i]))
+	}
+	c.w.strings(l)
+}
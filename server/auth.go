@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Op is the kind of operation a token is allowed to perform.
+type Op string
+
+const (
+	// OpRead covers get, list, mget and events.
+	OpRead Op = "read"
+	// OpWrite covers set, mset, incr and decr.
+	OpWrite Op = "write"
+	// OpDelete covers deleting keys and tags.
+	OpDelete Op = "delete"
+	// OpPurge covers purging a namespace.
+	OpPurge Op = "purge"
+	// OpPurgeAll covers purging everything.
+	OpPurgeAll Op = "purge-all"
+	// OpAdmin covers quotas and metrics.
+	OpAdmin Op = "admin"
+)
+
+var ops = map[Op]struct{}{
+	OpRead:     {},
+	OpWrite:    {},
+	OpDelete:   {},
+	OpPurge:    {},
+	OpPurgeAll: {},
+	OpAdmin:    {},
+}
+
+// Token grants a bearer token access to the namespaces matching the
+// *-wildcard patterns in Namespaces, AllNamespaces is required for
+// operations that span all namespaces.
+type Token struct {
+	Token      string   `json:"token"`
+	Namespaces []string `json:"namespaces"`
+	Ops        []Op     `json:"ops"`
+}
+
+// LoadTokens reads a json file of the form {"tokens": [Token...]}.
+func LoadTokens(path string) ([]Token, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf struct {
+		Tokens []Token `json:"tokens"`
+	}
+	if err := json.Unmarshal(raw, &conf); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for _, t := range conf.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("%s: empty token", path)
+		}
+		for _, op := range t.Ops {
+			if _, ok := ops[op]; !ok {
+				return nil, fmt.Errorf("%s: unknown op '%s'", path, op)
+			}
+		}
+	}
+
+	return conf.Tokens, nil
+}
+
+// SetTokens requires requests to carry one of tokens as bearer token,
+// a nil slice disables token authentication. It is safe to call while
+// serving.
+func (s *Server) SetTokens(tokens []Token) {
+	if tokens == nil {
+		s.tokens.Store(map[[sha256.Size]byte]Token(nil))
+		return
+	}
+
+	// Tokens are looked up by their hash so the lookup time does not
+	// depend on how much of a guessed token is correct.
+	m := make(map[[sha256.Size]byte]Token, len(tokens))
+	for _, t := range tokens {
+		m[sha256.Sum256([]byte(t.Token))] = t
+	}
+	s.tokens.Store(m)
+}
+
+func (t Token) permits(op Op, ns string, all bool) bool {
+	found := false
+	for _, o := range t.Ops {
+		if o == op {
+			found = true
+			break
+		}
+	}
+
+	return found && matchNamespace(t.Namespaces, ns, all)
+}
+
+// matchNamespace reports whether any pattern matches ns,
+// or if all is true, whether AllNamespaces is one of them.
+func matchNamespace(patterns []string, ns string, all bool) bool {
+	for _, p := range patterns {
+		if p == AllNamespaces {
+			return true
+		}
+
+		if all {
+			continue
+		}
+
+		match := p == ns
+		if !match && strings.Contains(p, "*") {
+			scanner(p, func(string) { match = true })(ns)
+		}
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorize checks whether r is allowed to perform op on namespace ns, or
+// on all namespaces if all is true. It returns 0 if so and otherwise the
+// http status code to respond with.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, op Op, ns string, all bool) int {
+	if !s.allowed(r, ns, all) {
+		return http.StatusForbidden
+	}
+
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	var token string
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		token = auth[len(prefix):]
+	}
+
+	known, permitted := s.Permits(token, op, ns, all)
+	if !known {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="webis"`)
+		return http.StatusUnauthorized
+	}
+
+	if !permitted {
+		return http.StatusForbidden
+	}
+
+	return 0
+}
+
+// Permits reports whether token is known and whether it permits op on
+// namespace ns, or on all namespaces if all is true. Both are true when
+// token authentication is disabled. It allows other protocols serving the
+// same cache to share the tokens.
+func (s *Server) Permits(token string, op Op, ns string, all bool) (known, permitted bool) {
+	tokens, _ := s.tokens.Load().(map[[sha256.Size]byte]Token)
+	if tokens == nil {
+		return true, true
+	}
+
+	t, ok := tokens[sha256.Sum256([]byte(token))]
+	return ok, ok && t.permits(op, ns, all)
+}
+
+func (s *Server) denied(w http.ResponseWriter, code int) {
+	w.WriteHeader(code)
+	if code == http.StatusUnauthorized {
+		w.Write([]byte("Unauthorized"))
+		return
+	}
+	w.Write([]byte("Forbidden"))
+}
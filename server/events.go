@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+// EventsPath streams cache changes as Server-Sent Events:
+//
+// GET /events?ns=<namespace>&key=<pattern>&tag=<pattern>
+//
+// ns defaults to the X-Namespace header, * subscribes to all namespaces.
+// key and tag are *-wildcard patterns matched against the key and any of
+// its tags. Every event is named after its reason and carries a JSONEvent.
+// A subscriber that falls behind receives an overflow event after which
+// the stream ends and it should consider its copy of the cache stale.
+const EventsPath = "events"
+
+const (
+	eventBuffer    = 1024
+	eventHeartbeat = time.Second * 15
+)
+
+// JSONEvent is the data of an event sent on /events.
+type JSONEvent struct {
+	Namespace string   `json:"namespace"`
+	Key       string   `json:"key"`
+	Tags      []string `json:"tags,omitempty"`
+	Reason    string   `json:"reason"`
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	ns := r.Header.Get(HeaderNS)
+	if v, ok := q["ns"]; ok {
+		ns = v[0]
+	}
+
+	all := ns == AllNamespaces
+	if code := s.authorize(w, r, OpRead, ns, all); code != 0 {
+		s.denied(w, code)
+		return
+	}
+
+	var matchKey, matchTag func(string) bool
+	if p := q.Get("key"); p != "" {
+		matchKey = pattern(p)
+	}
+	if p := q.Get("tag"); p != "" {
+		matchTag = pattern(p)
+	}
+
+	sub := s.c.Subscribe(eventBuffer, func(ev cache.Event) bool {
+		if !all && ev.Key.Namespace() != ns {
+			return false
+		}
+
+		if matchKey != nil && !matchKey(cleanDescriptor(string(ev.Key))) {
+			return false
+		}
+
+		if matchTag == nil {
+			return true
+		}
+		for _, t := range ev.Tags {
+			if matchTag(cleanDescriptor(string(t))) {
+				return true
+			}
+		}
+		return false
+	})
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+
+			tags := make([]string, len(ev.Tags))
+			for i := range ev.Tags {
+				tags[i] = cleanDescriptor(string(ev.Tags[i]))
+			}
+
+			data, err := json.Marshal(JSONEvent{
+				Namespace: ev.Key.Namespace(),
+				Key:       cleanDescriptor(string(ev.Key)),
+				Tags:      tags,
+				Reason:    string(ev.Reason),
+			})
+			if err != nil {
+				s.l.Println(err)
+				return
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Reason, data); err != nil {
+				return
+			}
+			// Flush once the burst is written rather than after every event.
+			if len(sub.C) == 0 {
+				flusher.Flush()
+			}
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+
+		case <-s.stop.Done():
+			return
+		}
+	}
+}
+
+// pattern returns a matcher for a *-wildcard pattern that is safe for
+// concurrent use.
+func pattern(p string) func(string) bool {
+	return func(v string) bool {
+		match := false
+		scanner(p, func(string) { match = true })(v)
+		return match
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	// HealthPath always responds 200 while the server is running.
+	HealthPath = "healthz"
+	// ReadyPath responds 200 when the server is ready and 503 otherwise.
+	ReadyPath = "readyz"
+)
+
+// SetReady marks the server as (not) ready to serve requests, e.g. while
+// a snapshot is being loaded or while shutting down. Until it is ready all
+// requests other than health checks and metrics get a 503.
+// A new server is ready.
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+// Ready reports whether the server is ready to serve requests.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// Shutdown stops accepting connections and waits for active requests
+// to finish or ctx to be done, Start and Serve return
+// http.ErrServerClosed once it is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.SetReady(false)
+	return s.s.Shutdown(ctx)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.Ready() {
+		s.notReady(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
+func (s *Server) notReady(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, "Not ready")
+}
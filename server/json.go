@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+// JSONPrefix is the path prefix of the versioned JSON API.
+const JSONPrefix = "v1/"
+
+// JSONRequest is the body of every JSON API call, which fields are used
+// depends on the endpoint.
+type JSONRequest struct {
+	Namespace string   `json:"namespace"`
+	Key       string   `json:"key,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Value     string   `json:"value,omitempty"`
+	// TTL in seconds, omitted means forever.
+	TTL *int64 `json:"ttl,omitempty"`
+	// Version only sets the key if its current version matches,
+	// 0 meaning it should not exist yet.
+	Version *uint64 `json:"version,omitempty"`
+}
+
+// JSONEntry is the response of /v1/get and /v1/set.
+type JSONEntry struct {
+	Key     string   `json:"key"`
+	Value   string   `json:"value,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Version uint64   `json:"version,omitempty"`
+	// TTL is the remaining time to live in seconds, omitted means forever.
+	TTL *int64 `json:"ttl,omitempty"`
+}
+
+// JSONList is the response of /v1/list and /v1/get by tag.
+type JSONList struct {
+	Keys []string `json:"keys,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// JSONError is the response of every failed JSON API call.
+type JSONError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// JSONOK is the response of successful del and purge calls.
+type JSONOK struct {
+	OK bool `json:"ok"`
+}
+
+var jsonOps = map[string]Op{
+	"set":       OpWrite,
+	"get":       OpRead,
+	"del":       OpDelete,
+	"list":      OpRead,
+	"purge":     OpPurge,
+	"purge-all": OpPurgeAll,
+}
+
+func (s *Server) handleJSON(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != "POST" {
+		s.jsonError(w, http.StatusMethodNotAllowed, "Only POST is supported")
+		return
+	}
+
+	op, ok := jsonOps[path]
+	if !ok {
+		s.jsonError(w, http.StatusNotFound, "Unknown endpoint")
+		return
+	}
+
+	var req JSONRequest
+	dec := json.NewDecoder(&limitReader{reader: r.Body, max: s.maxBodySize})
+	err := dec.Decode(&req)
+	r.Body.Close()
+	if err != nil {
+		if err == tooLarge {
+			s.jsonError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		s.jsonError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if code := s.authorize(w, r, op, req.Namespace, op == OpPurgeAll); code != 0 {
+		s.jsonError(w, code, http.StatusText(code))
+		return
+	}
+
+	tags := make([]cache.Tag, len(req.Tags))
+	for i := range req.Tags {
+		tags[i] = nsTag(req.Namespace, req.Tags[i])
+	}
+
+	var key cache.Key
+	if req.Key != "" {
+		key = nsKey(req.Namespace, req.Key)
+	}
+
+	switch path {
+	case "set":
+		s.jsonSet(w, key, tags, &req)
+	case "get":
+		s.jsonGet(w, key, tags)
+	case "del":
+		s.jsonDel(w, key, tags)
+	case "list":
+		s.jsonList(w, key, tags)
+	case "purge":
+		s.l.Printf("Purge NS %s", req.Namespace)
+		s.c.DelByPrefix(nsPrefix(req.Namespace))
+		s.jsonWrite(w, http.StatusOK, JSONOK{true})
+	case "purge-all":
+		s.l.Printf("Purge ALL")
+		s.c.DelAll()
+		s.jsonWrite(w, http.StatusOK, JSONOK{true})
+	}
+}
+
+func (s *Server) jsonSet(
+	w http.ResponseWriter,
+	key cache.Key,
+	tags []cache.Tag,
+	req *JSONRequest,
+) {
+	if key == "" {
+		s.jsonError(w, http.StatusBadRequest, "Invalid key")
+		return
+	}
+
+	var ttl time.Duration = math.MaxInt64
+	if req.TTL != nil {
+		if *req.TTL < 0 || *req.TTL > math.MaxInt32 {
+			s.jsonError(w, http.StatusBadRequest, "Invalid ttl")
+			return
+		}
+		ttl = time.Duration(*req.TTL) * time.Second
+	}
+
+	expires := time.Now().Add(ttl)
+	var version uint64
+	var err error
+	if req.Version != nil {
+		version, err = s.c.CompareAndSet(key, tags, req.Value, expires, *req.Version)
+	} else {
+		version, err = s.c.SetItem(key, cache.Item{Value: req.Value, Tags: tags, Expires: expires})
+	}
+
+	if err != nil {
+		s.jsonCacheError(w, err)
+		return
+	}
+
+	s.jsonWrite(
+		w,
+		http.StatusCreated,
+		JSONEntry{Key: req.Key, Tags: req.Tags, Version: version, TTL: req.TTL},
+	)
+	s.l.Printf("Create %s\t%v\t%dkB", key, tags, len(req.Value)/1024)
+}
+
+func (s *Server) jsonGet(w http.ResponseWriter, key cache.Key, tags []cache.Tag) {
+	if key == "" && len(tags) == 0 {
+		s.jsonError(w, http.StatusBadRequest, "No tags or key provided")
+		return
+	}
+
+	if key != "" {
+		item, ok := s.c.GetItem(key)
+		if !ok {
+			s.jsonError(w, http.StatusNotFound, "Not found")
+			return
+		}
+
+		entry := JSONEntry{
+			Key:     cleanDescriptor(string(key)),
+			Value:   item.Value,
+			Version: item.Version,
+		}
+		for _, t := range item.Tags {
+			entry.Tags = append(entry.Tags, cleanDescriptor(string(t)))
+		}
+		if ttl := time.Until(item.Expires) / time.Second; ttl <= math.MaxInt32 {
+			n := int64(ttl)
+			entry.TTL = &n
+		}
+
+		s.jsonWrite(w, http.StatusOK, entry)
+		return
+	}
+
+	keys := s.c.GetTagKeys(tags[0])
+	if keys == nil {
+		s.jsonError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	list := JSONList{Keys: make([]string, len(keys))}
+	for i := range keys {
+		list.Keys[i] = cleanDescriptor(string(keys[i]))
+	}
+	s.jsonWrite(w, http.StatusOK, list)
+}
+
+func (s *Server) jsonDel(w http.ResponseWriter, key cache.Key, tags []cache.Tag) {
+	if key == "" && len(tags) == 0 {
+		s.jsonError(w, http.StatusBadRequest, "No tags or key provided")
+		return
+	}
+
+	if key != "" {
+		s.c.Del(key)
+		s.l.Printf("Delete %s", key)
+	}
+
+	for i := range tags {
+		s.c.DelByTag(tags[i])
+		s.l.Printf("Delete tag %s", tags[i])
+	}
+
+	s.jsonWrite(w, http.StatusOK, JSONOK{true})
+}
+
+func (s *Server) jsonList(w http.ResponseWriter, key cache.Key, tags []cache.Tag) {
+	if key == "" && len(tags) == 0 {
+		s.jsonError(w, http.StatusBadRequest, "No tags or key provided")
+		return
+	}
+
+	list := JSONList{}
+	if key != "" {
+		list.Keys = make([]string, 0)
+		scan := scanner(string(key), func(k string) {
+			list.Keys = append(list.Keys, cleanDescriptor(k))
+		})
+		s.c.IterateKeys(func(k cache.Key) bool { scan(string(k)); return true })
+	} else {
+		list.Tags = make([]string, 0)
+		scan := scanner(string(tags[0]), func(k string) {
+			list.Tags = append(list.Tags, cleanDescriptor(k))
+		})
+		s.c.IterateTags(func(t cache.Tag) bool { scan(string(t)); return true })
+	}
+
+	s.jsonWrite(w, http.StatusOK, list)
+}
+
+func (s *Server) jsonCacheError(w http.ResponseWriter, err error) {
+	switch err {
+	case cache.ErrQuota:
+		s.jsonError(w, http.StatusInsufficientStorage, err.Error())
+	case cache.ErrVersion:
+		s.jsonError(w, http.StatusPreconditionFailed, err.Error())
+	case cache.ErrNotInteger, cache.ErrOverflow:
+		s.jsonError(w, http.StatusConflict, err.Error())
+	default:
+		s.jsonError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (s *Server) jsonError(w http.ResponseWriter, status int, msg string) {
+	var e JSONError
+	e.Error.Status = status
+	e.Error.Message = msg
+	s.jsonWrite(w, status, e)
+}
+
+func (s *Server) jsonWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.l.Println(err)
+	}
+}
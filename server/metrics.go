@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/frizinak/webis/proc"
+)
+
+// MetricsPath serves all metrics in the Prometheus text format.
+const MetricsPath = "metrics"
+
+// latencyBuckets are the upper bounds in seconds of the request duration
+// histogram.
+var latencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005,
+	0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5,
+	1,
+}
+
+// metricOps are the operation labels requests are accounted under, any
+// other route is accounted as unknown.
+var metricOps = []string{
+	"set", "get", "list", "del", "purge", "purge-all",
+	"mget", "mset", "incr", "decr", "quota",
+	"v1/set", "v1/get", "v1/list", "v1/del", "v1/purge", "v1/purge-all",
+	MetricsPath, HealthPath, ReadyPath, EventsPath, "unknown",
+}
+
+type opMetrics struct {
+	// codes counts responses by status class, codes[2] being 2xx.
+	codes   [6]uint64
+	buckets []uint64
+	count   uint64
+	sum     uint64 // nanoseconds
+}
+
+type metrics struct {
+	ops map[string]*opMetrics
+	ns  bool
+}
+
+func newMetrics() *metrics {
+	m := &metrics{ops: make(map[string]*opMetrics, len(metricOps))}
+	for _, op := range metricOps {
+		m.ops[op] = &opMetrics{buckets: make([]uint64, len(latencyBuckets))}
+	}
+	return m
+}
+
+func (m *metrics) observe(op string, code int, d time.Duration) {
+	o, ok := m.ops[op]
+	if !ok {
+		o = m.ops["unknown"]
+	}
+
+	if class := code / 100; class > 0 && class < len(o.codes) {
+		atomic.AddUint64(&o.codes[class], 1)
+	}
+
+	sec := d.Seconds()
+	for i, le := range latencyBuckets {
+		if sec <= le {
+			atomic.AddUint64(&o.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&o.count, 1)
+	atomic.AddUint64(&o.sum, uint64(d))
+}
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// SetNamespaceMetrics enables per namespace key and byte gauges, which
+// are left out by default as namespaces are unbounded.
+func (s *Server) SetNamespaceMetrics(enable bool) {
+	s.metrics.ns = enable
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	fmt.Fprintln(b, "# HELP webis_requests_total Requests by operation and status class.")
+	fmt.Fprintln(b, "# TYPE webis_requests_total counter")
+	for _, op := range metricOps {
+		o := s.metrics.ops[op]
+		for class := 1; class < len(o.codes); class++ {
+			if n := atomic.LoadUint64(&o.codes[class]); n != 0 {
+				fmt.Fprintf(b, "webis_requests_total{op=%q,code=\"%dxx\"} %d\n", op, class, n)
+			}
+		}
+	}
+
+	fmt.Fprintln(b, "# HELP webis_request_duration_seconds Request latency by operation.")
+	fmt.Fprintln(b, "# TYPE webis_request_duration_seconds histogram")
+	for _, op := range metricOps {
+		o := s.metrics.ops[op]
+		count := atomic.LoadUint64(&o.count)
+		if count == 0 {
+			continue
+		}
+
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += atomic.LoadUint64(&o.buckets[i])
+			fmt.Fprintf(
+				b,
+				"webis_request_duration_seconds_bucket{op=%q,le=\"%s\"} %d\n",
+				op,
+				strconv.FormatFloat(le, 'g', -1, 64),
+				cum,
+			)
+		}
+		fmt.Fprintf(b, "webis_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, count)
+		fmt.Fprintf(
+			b,
+			"webis_request_duration_seconds_sum{op=%q} %s\n",
+			op,
+			strconv.FormatFloat(time.Duration(atomic.LoadUint64(&o.sum)).Seconds(), 'g', -1, 64),
+		)
+		fmt.Fprintf(b, "webis_request_duration_seconds_count{op=%q} %d\n", op, count)
+	}
+
+	stats := s.c.Stats()
+	gauge := func(name, help string, v uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+
+	counter("webis_cache_hits_total", "Lookups of an existing key.", stats.Hits)
+	counter("webis_cache_misses_total", "Lookups of a missing or expired key.", stats.Misses)
+	gauge("webis_keys", "Keys stored.", uint64(s.c.Len()))
+	gauge("webis_tags", "Tags stored.", uint64(s.c.TagsLen()))
+	gauge("webis_bytes", "Estimated bytes stored.", s.c.Usage().Bytes())
+
+	fmt.Fprintln(b, "# HELP webis_removed_total Keys removed other than by an explicit delete.")
+	fmt.Fprintln(b, "# TYPE webis_removed_total counter")
+	for _, r := range []struct {
+		reason string
+		n      uint64
+	}{
+		{"expired", stats.Expired},
+		{"oom", stats.Evicted},
+		{"quota", stats.QuotaEvicted},
+		{"tag", stats.TagDeleted},
+		{"purge", stats.Purged},
+	} {
+		fmt.Fprintf(b, "webis_removed_total{reason=%q} %d\n", r.reason, r.n)
+	}
+
+	if rss, err := proc.GetRSS(strconv.Itoa(os.Getpid())); err == nil {
+		gauge("process_resident_memory_bytes", "Resident memory size in bytes.", rss)
+	}
+
+	if !s.metrics.ns {
+		return
+	}
+
+	usage := s.c.Namespaces()
+	names := make([]string, 0, len(usage))
+	for ns := range usage {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(b, "# HELP webis_namespace_keys Keys stored by namespace.")
+	fmt.Fprintln(b, "# TYPE webis_namespace_keys gauge")
+	for _, ns := range names {
+		fmt.Fprintf(b, "webis_namespace_keys{ns=\"%s\"} %d\n", escapeLabel(ns), usage[ns].Keys)
+	}
+
+	fmt.Fprintln(b, "# HELP webis_namespace_bytes Estimated bytes stored by namespace.")
+	fmt.Fprintln(b, "# TYPE webis_namespace_bytes gauge")
+	for _, ns := range names {
+		fmt.Fprintf(b, "webis_namespace_bytes{ns=\"%s\"} %d\n", escapeLabel(ns), usage[ns].Bytes())
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frizinak/webis/cache"
+)
+
+// Multi key requests and responses are framed as netstrings
+// (https://cr.yp.to/proto/netstrings.txt): <length>:<data>,
+//
+// /mget request:  <key>...
+// /mget response: (<key><hit|miss><value>)...
+// /mset request:  (<key><ttl><tags><value>)... where tags is itself
+//                 a sequence of netstrings.
+// /mset response: (<key><ok|error message>)...
+
+const (
+	StatusHit  = "hit"
+	StatusMiss = "miss"
+	StatusOK   = "ok"
+)
+
+var errFrame = errors.New("Invalid netstring")
+
+// readNetstring reads a single netstring of at most max bytes.
+func readNetstring(r *bufio.Reader, max int) ([]byte, error) {
+	l, err := r.ReadString(':')
+	if err != nil {
+		if err == io.EOF && l == "" {
+			return nil, io.EOF
+		}
+		if err == tooLarge {
+			return nil, err
+		}
+		return nil, errFrame
+	}
+
+	n, err := strconv.Atoi(l[:len(l)-1])
+	if err != nil || n < 0 {
+		return nil, errFrame
+	}
+	if n > max {
+		return nil, tooLarge
+	}
+
+	b := make([]byte, n+1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == tooLarge {
+			return nil, err
+		}
+		return nil, errFrame
+	}
+
+	if b[n] != ',' {
+		return nil, errFrame
+	}
+
+	return b[:n], nil
+}
+
+func writeNetstring(w io.Writer, b []byte) error {
+	if _, err := fmt.Fprintf(w, "%d:", len(b)); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{','})
+	return err
+}
+
+func (s *Server) handleMGet(
+	w http.ResponseWriter,
+	key cache.Key,
+	tags []cache.Tag,
+	r *http.Request,
+) {
+	ns := r.Header.Get(HeaderNS)
+	body := bufio.NewReader(&limitReader{reader: r.Body, max: s.maxBodySize})
+	defer r.Body.Close()
+
+	keys := make([][]byte, 0)
+	for {
+		k, err := readNetstring(body, s.maxBodySize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.multiError(w, err)
+			return
+		}
+		keys = append(keys, k)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	buf := bufio.NewWriter(w)
+	for _, k := range keys {
+		writeNetstring(buf, k)
+		v, ok := s.c.Get(nsKey(ns, string(k)))
+		if !ok {
+			writeNetstring(buf, []byte(StatusMiss))
+			writeNetstring(buf, nil)
+			continue
+		}
+		writeNetstring(buf, []byte(StatusHit))
+		writeNetstring(buf, []byte(v))
+	}
+
+	if err := buf.Flush(); err != nil {
+		s.l.Println(err)
+	}
+}
+
+func (s *Server) handleMSet(
+	w http.ResponseWriter,
+	key cache.Key,
+	tags []cache.Tag,
+	r *http.Request,
+) {
+	type record struct {
+		key   []byte
+		tags  []cache.Tag
+		ttl   time.Duration
+		value []byte
+	}
+
+	ns := r.Header.Get(HeaderNS)
+	body := bufio.NewReader(&limitReader{reader: r.Body, max: s.maxBodySize})
+	defer r.Body.Close()
+
+	// Parse the entire body before storing anything so a malformed
+	// request has no effect.
+	records := make([]record, 0)
+	for {
+		var rec record
+		var err error
+		var ttl, rawTags []byte
+		if rec.key, err = readNetstring(body, s.maxBodySize); err == io.EOF {
+			break
+		}
+		if err == nil {
+			ttl, err = readNetstring(body, s.maxBodySize)
+		}
+		if err == nil {
+			rawTags, err = readNetstring(body, s.maxBodySize)
+		}
+		if err == nil {
+			rec.value, err = readNetstring(body, s.maxBodySize)
+		}
+		if err == nil && len(rec.key) == 0 {
+			err = errors.New("Invalid key")
+		}
+		if err == nil {
+			if rec.ttl, err = parseTTL(string(ttl)); err != nil {
+				err = errors.New("Invalid ttl")
+			}
+		}
+		if err == nil {
+			tagReader := bufio.NewReader(bytes.NewReader(rawTags))
+			for {
+				t, terr := readNetstring(tagReader, s.maxBodySize)
+				if terr == io.EOF {
+					break
+				}
+				if terr != nil {
+					err = terr
+					break
+				}
+				rec.tags = append(rec.tags, nsTag(ns, string(t)))
+			}
+		}
+		if err == io.EOF {
+			err = errFrame
+		}
+		if err != nil {
+			s.multiError(w, err)
+			return
+		}
+
+		records = append(records, rec)
+	}
+
+	now := time.Now()
+	w.WriteHeader(http.StatusOK)
+	buf := bufio.NewWriter(w)
+	for _, rec := range records {
+		status := StatusOK
+		k := nsKey(ns, string(rec.key))
+		if err := s.c.Set(k, rec.tags, string(rec.value), now.Add(rec.ttl)); err != nil {
+			status = err.Error()
+		}
+		writeNetstring(buf, rec.key)
+		writeNetstring(buf, []byte(status))
+		s.l.Printf("Create %s\t%v\t%dkB", k, rec.tags, len(rec.value)/1024)
+	}
+
+	if err := buf.Flush(); err != nil {
+		s.l.Println(err)
+	}
+}
+
+func (s *Server) multiError(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusNotAcceptable)
+	if err == tooLarge {
+		fmt.Fprintf(w, "Request body too large. Max %d KiB", s.maxBodySize/1024)
+		return
+	}
+	fmt.Fprint(w, err.Error())
+}
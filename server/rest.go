@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/frizinak/webis/cache"
+)
+
+// RESTPrefix is the path prefix of the path based API:
+//
+// GET, PUT, DELETE /ns/<namespace>/keys/<key>
+// GET              /ns/<namespace>/keys?match=<pattern>
+// GET, DELETE      /ns/<namespace>/tags/<tag>
+// GET              /ns/<namespace>/tags?match=<pattern>
+// DELETE           /ns/<namespace>
+//
+// Path segments are url-escaped, the namespace in the path overrides
+// the X-Namespace header, all other headers behave as usual.
+const RESTPrefix = "ns/"
+
+// handleREST returns the operation name the request is accounted under.
+func (s *Server) handleREST(w http.ResponseWriter, r *http.Request) string {
+	p := strings.SplitN(strings.Trim(r.URL.EscapedPath(), "/"), "/", 4)
+	for i := range p {
+		var err error
+		if p[i], err = url.PathUnescape(p[i]); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return "unknown"
+		}
+	}
+
+	// p[0] == "ns"
+	if len(p) < 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return "unknown"
+	}
+
+	ns := p[1]
+	r.Header.Set(HeaderNS, ns)
+	tags := headerTags(r.Header)
+	var key cache.Key
+	var handler func(
+		w http.ResponseWriter,
+		key cache.Key,
+		tags []cache.Tag,
+		r *http.Request,
+	) = nil
+	var allow, name string
+	var op Op
+
+	switch {
+	case len(p) == 2:
+		allow = "DELETE"
+		if r.Method == "DELETE" {
+			handler, op, name = s.handlePurge, OpPurge, "purge"
+		}
+
+	case len(p) == 3 && (p[2] == "keys" || p[2] == "tags"):
+		allow = "GET, HEAD"
+		match := r.URL.Query().Get("match")
+		if match == "" {
+			match = "*"
+		}
+
+		key, tags = nsKey(ns, match), nil
+		if p[2] == "tags" {
+			key, tags = "", []cache.Tag{nsTag(ns, match)}
+		}
+
+		if r.Method == "GET" || r.Method == "HEAD" {
+			handler, op, name = s.handleList, OpRead, "list"
+		}
+
+	case len(p) == 4 && p[2] == "keys" && p[3] != "":
+		allow = "GET, HEAD, PUT, DELETE"
+		key = nsKey(ns, p[3])
+		switch r.Method {
+		case "GET", "HEAD":
+			handler, op, name = s.handleGet, OpRead, "get"
+		case "PUT":
+			handler, op, name = s.handleSet, OpWrite, "set"
+		case "DELETE":
+			handler, op, name = s.handleDel, OpDelete, "del"
+		}
+
+	case len(p) == 4 && p[2] == "tags" && p[3] != "":
+		allow = "GET, HEAD, DELETE"
+		tags = []cache.Tag{nsTag(ns, p[3])}
+		switch r.Method {
+		case "GET", "HEAD":
+			handler, op, name = s.handleGet, OpRead, "get"
+		case "DELETE":
+			handler, op, name = s.handleDel, OpDelete, "del"
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return "unknown"
+	}
+
+	if handler == nil {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return "unknown"
+	}
+
+	if code := s.authorize(w, r, op, ns, false); code != 0 {
+		s.denied(w, code)
+		return name
+	}
+
+	handler(w, key, tags, r)
+	return name
+}
@@ -1,15 +1,18 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/frizinak/webis/cache"
@@ -20,17 +23,53 @@ const (
 	HeaderTags = "X-Tags"
 	HeaderNS   = "X-Namespace"
 	HeaderTTL  = "X-TTL"
+
+	HeaderDelta   = "X-Delta"
+	HeaderInitial = "X-Initial"
+
+	HeaderVersion       = "X-Version"
+	HeaderExpectVersion = "X-Expect-Version"
+
+	HeaderMaxBytes  = "X-Max-Bytes"
+	HeaderMaxKeys   = "X-Max-Keys"
+	HeaderQuotaMode = "X-Quota-Mode"
+)
+
+// HeaderMetaPrefix marks user defined headers that are stored with the
+// value on /set and replayed on /get.
+const HeaderMetaPrefix = "X-Meta-"
+
+// metaHeaders are the standard headers stored with the value on /set and
+// replayed on /get.
+var metaHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Disposition",
+}
+
+const (
+	QuotaEvict  = "evict"
+	QuotaReject = "reject"
 )
 
 var tooLarge = errors.New("Too large")
 var zeroRune rune = 0
-var zero = string([]byte{byte(zeroRune)})
+var zero = cache.NSSep
 
 type Server struct {
 	s           *http.Server
 	c           *cache.Cache
 	l           *log.Logger
 	maxBodySize int
+	clientNS    map[string][]string
+	tokens      atomic.Value // map[[sha256.Size]byte]Token
+	metrics     *metrics
+	ready       int32
+
+	// stop is canceled on shutdown to end long lived requests.
+	stop        context.Context
+	stopStreams context.CancelFunc
 }
 
 func (s *Server) handleList(
@@ -105,13 +144,94 @@ func (s *Server) handleSet(
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	s.c.Set(key, tags, string(data), time.Now().Add(ttl))
+	item := cache.Item{
+		Value:   string(data),
+		Tags:    tags,
+		Expires: time.Now().Add(ttl),
+		Meta:    headerMeta(r.Header),
+	}
+
+	var version uint64
+	if expect := r.Header.Get(HeaderExpectVersion); expect != "" {
+		expected, perr := strconv.ParseUint(expect, 10, 64)
+		if perr != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			fmt.Fprintf(w, "Invalid version")
+			return
+		}
+		version, err = s.c.CompareAndSetItem(key, item, expected)
+	} else {
+		version, err = s.c.SetItem(key, item)
+	}
+
+	if err != nil {
+		s.setError(w, err)
+		return
+	}
 
+	w.Header().Set(HeaderVersion, strconv.FormatUint(version, 10))
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintf(w, "OK")
 	s.l.Printf("Create %s\t%v\t%dkB", key, tags, len(data)/1024)
 }
 
+func (s *Server) handleIncr(
+	w http.ResponseWriter,
+	key cache.Key,
+	tags []cache.Tag,
+	r *http.Request,
+) {
+	if key == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		fmt.Fprintf(w, "Invalid key")
+		return
+	}
+
+	ttl, err := headerTTL(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		fmt.Fprintf(w, "Invalid ttl")
+		return
+	}
+
+	delta, initial, err := headerCounter(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		fmt.Fprintf(w, "Invalid delta or initial value")
+		return
+	}
+
+	if strings.Trim(r.URL.Path, "/") == "decr" {
+		delta = -delta
+	}
+
+	n, err := s.c.Incr(key, tags, delta, initial, time.Now().Add(ttl))
+	if err != nil {
+		s.setError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d", n)
+	s.l.Printf("Incr %s\t%d\t%d", key, delta, n)
+}
+
+func (s *Server) setError(w http.ResponseWriter, err error) {
+	switch err {
+	case cache.ErrNotInteger, cache.ErrOverflow:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err.Error())
+	case cache.ErrQuota:
+		w.WriteHeader(http.StatusInsufficientStorage)
+		fmt.Fprintf(w, "Namespace quota exceeded")
+	case cache.ErrVersion:
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "Version mismatch")
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) handleGet(
 	w http.ResponseWriter,
 	key cache.Key,
@@ -125,17 +245,20 @@ func (s *Server) handleGet(
 	}
 
 	if key != "" {
-		v, ok := s.c.Get(key)
+		v, ok := s.c.GetItem(key)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintf(w, "Not found")
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-
-		if _, err := strings.NewReader(v).WriteTo(w); err != nil {
-			s.l.Println(err)
+		for name, value := range v.Meta {
+			w.Header().Set(name, value)
 		}
+		w.Header().Set("ETag", etag(v.Version))
+		w.Header().Set(HeaderVersion, strconv.FormatUint(v.Version, 10))
+
+		// ServeContent handles conditional and range requests.
+		http.ServeContent(w, r, "", v.Modified, strings.NewReader(v.Value))
 		return
 	}
 
@@ -212,8 +335,96 @@ func (s *Server) handlePurgeAll(
 	fmt.Fprintf(w, "OK")
 }
 
+func (s *Server) handleQuota(
+	w http.ResponseWriter,
+	key cache.Key,
+	tags []cache.Tag,
+	r *http.Request,
+) {
+	if r.Method == "GET" {
+		w.WriteHeader(http.StatusOK)
+		for ns, q := range s.c.Quotas() {
+			u := s.c.NamespaceUsage(ns)
+			mode := QuotaEvict
+			if q.Reject {
+				mode = QuotaReject
+			}
+			fmt.Fprintf(
+				w,
+				"%s\t%d/%d\t%d/%d\t%s\n",
+				ns,
+				u.Bytes(),
+				q.MaxBytes,
+				u.Keys,
+				q.MaxKeys,
+				mode,
+			)
+		}
+		return
+	}
+
+	q, err := headerQuota(r.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		fmt.Fprintf(w, "Invalid quota: %s", err)
+		return
+	}
+
+	ns := r.Header.Get(HeaderNS)
+	s.c.SetQuota(ns, q)
+	s.l.Printf("Quota %s\t%d bytes\t%d keys", ns, q.MaxBytes, q.MaxKeys)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
 func (s *Server) req(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	op := s.route(sw, r)
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	s.metrics.observe(op, sw.code, time.Since(start))
+}
+
+// route dispatches r and returns the name it is accounted under in the
+// metrics.
+func (s *Server) route(w http.ResponseWriter, r *http.Request) string {
 	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == HealthPath && (r.Method == "GET" || r.Method == "HEAD"):
+		s.handleHealth(w, r)
+		return path
+	case path == ReadyPath && (r.Method == "GET" || r.Method == "HEAD"):
+		s.handleReady(w, r)
+		return path
+	case path == MetricsPath && r.Method == "GET":
+		if code := s.authorize(w, r, OpAdmin, "", true); code != 0 {
+			s.denied(w, code)
+			return path
+		}
+		s.handleMetrics(w, r)
+		return path
+	case !s.Ready():
+		s.notReady(w)
+		return "unknown"
+	case path == EventsPath && r.Method == "GET":
+		s.handleEvents(w, r)
+		return path
+	}
+
+	if strings.HasPrefix(path, JSONPrefix) {
+		s.handleJSON(w, r, path[len(JSONPrefix):])
+		if _, ok := jsonOps[path[len(JSONPrefix):]]; ok {
+			return path
+		}
+		return "unknown"
+	}
+
+	if strings.HasPrefix(path+"/", RESTPrefix) {
+		return s.handleREST(w, r)
+	}
+
 	key := headerKey(r.Header)
 	tags := headerTags(r.Header)
 	var handler func(
@@ -223,33 +434,63 @@ func (s *Server) req(w http.ResponseWriter, r *http.Request) {
 		r *http.Request,
 	) = nil
 
+	var op Op
 	switch {
 	case path == "set" && r.Method == "POST":
-		handler = s.handleSet
+		handler, op = s.handleSet, OpWrite
 	case path == "get" && r.Method == "GET":
-		handler = s.handleGet
+		handler, op = s.handleGet, OpRead
 	case path == "list" && r.Method == "GET":
-		handler = s.handleList
+		handler, op = s.handleList, OpRead
 	case path == "del" && r.Method == "POST":
-		handler = s.handleDel
+		handler, op = s.handleDel, OpDelete
 	case path == "purge" && r.Method == "POST":
-		handler = s.handlePurge
+		handler, op = s.handlePurge, OpPurge
 	case path == "purge-all" && r.Method == "POST":
-		handler = s.handlePurgeAll
+		handler, op = s.handlePurgeAll, OpPurgeAll
+	case path == "mget" && r.Method == "POST":
+		handler, op = s.handleMGet, OpRead
+	case path == "mset" && r.Method == "POST":
+		handler, op = s.handleMSet, OpWrite
+	case (path == "incr" || path == "decr") && r.Method == "POST":
+		handler, op = s.handleIncr, OpWrite
+	case path == "quota" && (r.Method == "GET" || r.Method == "POST"):
+		handler, op = s.handleQuota, OpAdmin
 	}
 
-	if handler != nil {
-		handler(w, key, tags, r)
-		return
+	if handler == nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return "unknown"
 	}
 
-	w.WriteHeader(http.StatusNotAcceptable)
+	all := op == OpPurgeAll || (op == OpAdmin && r.Method == "GET")
+	if code := s.authorize(w, r, op, r.Header.Get(HeaderNS), all); code != 0 {
+		s.denied(w, code)
+		return path
+	}
+
+	handler(w, key, tags, r)
+	return path
 }
 
 func (s *Server) Start() error {
+	if s.s.TLSConfig != nil {
+		return s.s.ListenAndServeTLS("", "")
+	}
 	return s.s.ListenAndServe()
 }
 
+// Serve accepts connections on l, it can be called for multiple listeners
+// alongside Start.
+// Unix sockets always serve plain http, access to them is controlled by
+// the socket's file mode and owner.
+func (s *Server) Serve(l net.Listener) error {
+	if s.s.TLSConfig != nil && l.Addr().Network() != "unix" {
+		return s.s.ServeTLS(l, "", "")
+	}
+	return s.s.Serve(l)
+}
+
 func New(
 	addr string,
 	l *log.Logger,
@@ -264,7 +505,16 @@ func New(
 		ReadTimeout:       readTimeout,
 		ReadHeaderTimeout: readHeaderTimeout,
 	}
-	server := &Server{s, c, l, maxBodySize}
+	server := &Server{
+		s:           s,
+		c:           c,
+		l:           l,
+		maxBodySize: maxBodySize,
+		metrics:     newMetrics(),
+		ready:       1,
+	}
+	server.stop, server.stopStreams = context.WithCancel(context.Background())
+	s.RegisterOnShutdown(server.stopStreams)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", server.req)
 	s.Handler = mux
@@ -304,6 +554,11 @@ func tags(t []string) []cache.Tag {
 	return ts
 }
 
+// etag returns the strong entity tag of an entry version.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
 func cleanDescriptor(i string) string {
 	for j, n := range i {
 		if n == zeroRune && len(i) > j+1 {
@@ -311,12 +566,18 @@ func cleanDescriptor(i string) string {
 		}
 	}
 	return i
+}
 
-	r := strings.SplitN(i, zero, 2)
-	if len(r) == 2 {
-		return r[1]
-	}
-	return r[0]
+func nsKey(ns, key string) cache.Key {
+	return cache.Key(strings.Join([]string{ns, key}, zero))
+}
+
+func nsTag(ns, tag string) cache.Tag {
+	return cache.Tag(strings.Join([]string{ns, tag}, zero))
+}
+
+func nsPrefix(ns string) cache.Key {
+	return cache.Key(ns + zero)
 }
 
 func headerKey(h http.Header) cache.Key {
@@ -325,35 +586,62 @@ func headerKey(h http.Header) cache.Key {
 		return ""
 	}
 
-	return cache.Key(
-		strings.Join([]string{h.Get(HeaderNS), h.Get(HeaderKey)}, zero),
-	)
+	return nsKey(h.Get(HeaderNS), k)
 }
 
 func headerKeyPrefix(h http.Header) cache.Key {
-	return cache.Key(h.Get(HeaderNS) + zero)
+	return nsPrefix(h.Get(HeaderNS))
 }
 
 func headerTags(h http.Header) []cache.Tag {
 	t := h[HeaderTags]
 	ts := make([]cache.Tag, len(t))
 	for i := range t {
-		ts[i] = cache.Tag(strings.Join([]string{h.Get(HeaderNS), t[i]}, zero))
+		ts[i] = nsTag(h.Get(HeaderNS), t[i])
 	}
 	return ts
 }
 
+// headerMeta returns the headers to store with a value.
+func headerMeta(h http.Header) map[string]string {
+	var m map[string]string
+	add := func(name string) {
+		if m == nil {
+			m = make(map[string]string)
+		}
+		m[name] = h.Get(name)
+	}
+
+	for _, name := range metaHeaders {
+		if h.Get(name) != "" {
+			add(name)
+		}
+	}
+
+	for name := range h {
+		if strings.HasPrefix(name, HeaderMetaPrefix) {
+			add(name)
+		}
+	}
+
+	return m
+}
+
 func headerTTL(h http.Header) (time.Duration, error) {
 	v := h[HeaderTTL]
 	if len(v) == 0 {
 		v = []string{h.Get(HeaderTTL)}
 	}
 
-	if len(v) == 0 || v[0] == "" {
+	return parseTTL(v[0])
+}
+
+func parseTTL(v string) (time.Duration, error) {
+	if v == "" {
 		return math.MaxInt64, nil
 	}
 
-	i, err := strconv.ParseInt(v[0], 10, 32)
+	i, err := strconv.ParseInt(v, 10, 32)
 	if err != nil {
 		return 0, err
 	}
@@ -361,6 +649,47 @@ func headerTTL(h http.Header) (time.Duration, error) {
 	return time.Duration(i) * time.Second, nil
 }
 
+func headerCounter(h http.Header) (delta, initial int64, err error) {
+	delta = 1
+	if v := h.Get(HeaderDelta); v != "" {
+		if delta, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return
+		}
+	}
+
+	if v := h.Get(HeaderInitial); v != "" {
+		initial, err = strconv.ParseInt(v, 10, 64)
+	}
+
+	return
+}
+
+func headerQuota(h http.Header) (cache.Quota, error) {
+	q := cache.Quota{}
+	var err error
+	if v := h.Get(HeaderMaxBytes); v != "" {
+		if q.MaxBytes, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return q, err
+		}
+	}
+
+	if v := h.Get(HeaderMaxKeys); v != "" {
+		if q.MaxKeys, err = strconv.Atoi(v); err != nil {
+			return q, err
+		}
+	}
+
+	switch h.Get(HeaderQuotaMode) {
+	case "", QuotaEvict:
+	case QuotaReject:
+		q.Reject = true
+	default:
+		return q, errors.New("Invalid quota mode")
+	}
+
+	return q, nil
+}
+
 func scanner(input string, match func(string)) func(string) {
 	_ps := strings.Split(input, "*")
 	return func(k string) {
@@ -378,7 +707,7 @@ func scanner(input string, match func(string)) func(string) {
 			if !strings.HasSuffix(key, ps[len(ps)-1]) {
 				return
 			}
-			key = key[:len(ps[len(ps)-1])]
+			key = key[:len(key)-len(ps[len(ps)-1])]
 			ps = ps[:len(ps)-1]
 		}
 
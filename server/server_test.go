@@ -1,10 +1,25 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -125,6 +140,311 @@ func TestSimpleIntegrationGetSetDel(t *testing.T) {
 	}
 }
 
+func TestCompareAndSet(t *testing.T) {
+	s := newServer()
+	set := func(expect string) *responseWriter {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, err := http.NewRequest("POST", "http://localhost/set", bytes.NewReader([]byte("data")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(HeaderKey, "key")
+		req.Header.Set(HeaderExpectVersion, expect)
+		s.req(res, req)
+		return res
+	}
+
+	res := set("0")
+	testReq(t, http.StatusCreated, res.code, res.buf.Bytes(), nil)
+	version := res.header.Get(HeaderVersion)
+
+	res = set("0")
+	testReq(t, http.StatusPreconditionFailed, res.code, res.buf.Bytes(), nil)
+
+	res = &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+	req, _ := http.NewRequest("GET", "http://localhost/get", nil)
+	req.Header.Set(HeaderKey, "key")
+	s.req(res, req)
+	testReq(t, http.StatusOK, res.code, res.buf.Bytes(), nil)
+	if res.header.Get(HeaderVersion) != version {
+		t.Fatalf("Version %s does not match %s", res.header.Get(HeaderVersion), version)
+	}
+
+	res = set(version)
+	testReq(t, http.StatusCreated, res.code, res.buf.Bytes(), nil)
+	res = set(version)
+	testReq(t, http.StatusPreconditionFailed, res.code, res.buf.Bytes(), nil)
+
+	// Plain sets return their version to start a chain with.
+	res = set("")
+	testReq(t, http.StatusCreated, res.code, res.buf.Bytes(), nil)
+	res = set(res.header.Get(HeaderVersion))
+	testReq(t, http.StatusCreated, res.code, res.buf.Bytes(), nil)
+}
+
+func TestIncr(t *testing.T) {
+	s := newServer()
+	incr := func(path, ns, delta string) (int, string) {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, err := http.NewRequest("POST", "http://localhost/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(HeaderKey, "counter")
+		req.Header.Set(HeaderNS, ns)
+		req.Header.Set(HeaderDelta, delta)
+		req.Header.Set(HeaderTags, "tag")
+		s.req(res, req)
+		return res.code, res.buf.String()
+	}
+
+	for _, c := range []struct {
+		path, ns, delta string
+		expect          string
+	}{
+		{"incr", "ns", "", "1"},
+		{"incr", "ns", "5", "6"},
+		{"decr", "ns", "2", "4"},
+		{"incr", "other", "", "1"},
+	} {
+		code, body := incr(c.path, c.ns, c.delta)
+		if code != http.StatusOK || body != c.expect {
+			t.Fatalf("%s %s %s: expected %s got [%d] %s", c.path, c.ns, c.delta, c.expect, code, body)
+		}
+	}
+
+	// DEL tag
+	code, data, err := makeReq(s, "POST", "del", nil, "ns", "", "", []string{"tag"})
+	testReq(t, http.StatusOK, code, data, err)
+	if _, body := incr("incr", "ns", ""); body != "1" {
+		t.Fatalf("Counter not deleted by tag: %s", body)
+	}
+
+	code, data, err = makeReq(s, "POST", "set", []byte("data"), "ns", "counter", "", nil)
+	testReq(t, http.StatusCreated, code, data, err)
+	if code, _ := incr("incr", "ns", ""); code != http.StatusConflict {
+		t.Fatalf("Expected a conflict, got %d", code)
+	}
+}
+
+func TestMultiGetSet(t *testing.T) {
+	s := newServer()
+	do := func(path string, fields ...string) (int, []string) {
+		body := bytes.NewBuffer(nil)
+		for _, f := range fields {
+			writeNetstring(body, []byte(f))
+		}
+
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, err := http.NewRequest("POST", "http://localhost/"+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(HeaderNS, "ns")
+		s.req(res, req)
+
+		r := bufio.NewReader(res.buf)
+		out := make([]string, 0)
+		for {
+			f, err := readNetstring(r, 1024)
+			if err != nil {
+				break
+			}
+			out = append(out, string(f))
+		}
+		return res.code, out
+	}
+
+	tags := bytes.NewBuffer(nil)
+	writeNetstring(tags, []byte("tag1"))
+	writeNetstring(tags, []byte("tag2"))
+	code, out := do(
+		"mset",
+		"uno", "100", tags.String(), "data1",
+		"dos", "", "", "data2",
+	)
+	if code != http.StatusOK || strings.Join(out, " ") != "uno ok dos ok" {
+		t.Fatalf("Unexpected response [%d] %v", code, out)
+	}
+
+	code, out = do("mget", "uno", "tres", "dos")
+	expect := "uno hit data1 tres miss  dos hit data2"
+	if code != http.StatusOK || strings.Join(out, " ") != expect {
+		t.Fatalf("Unexpected response [%d] %v", code, out)
+	}
+
+	code, out = do("mset", "uno", "100")
+	if code != http.StatusNotAcceptable {
+		t.Fatalf("Expected truncated record to fail: [%d] %v", code, out)
+	}
+
+	// DEL tag2
+	code, data, err := makeReq(s, "POST", "del", nil, "ns", "", "", []string{"tag2"})
+	testReq(t, http.StatusOK, code, data, err)
+	if _, out = do("mget", "uno"); out[1] != StatusMiss {
+		t.Fatal("Tags were not stored")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	s := newServer()
+	do := func(path, body string, v interface{}) int {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, err := http.NewRequest("POST", "http://localhost/v1/"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.req(res, req)
+		if err := json.Unmarshal(res.buf.Bytes(), v); err != nil {
+			t.Fatalf("%s: %s", err, res.buf.String())
+		}
+		return res.code
+	}
+
+	var entry JSONEntry
+	code := do("set", `{"namespace":"ns","key":"uno","value":"data","tags":["tag"],"ttl":100,"version":0}`, &entry)
+	if code != http.StatusCreated || entry.Version == 0 {
+		t.Fatalf("[%d] %+v", code, entry)
+	}
+
+	version := entry.Version
+	entry = JSONEntry{}
+	code = do("set", `{"namespace":"ns","key":"dos","value":"data"}`, &entry)
+	if code != http.StatusCreated || entry.Version <= version {
+		t.Fatalf("Plain set without a new version: [%d] %+v", code, entry)
+	}
+
+	var jerr JSONError
+	code = do("set", `{"namespace":"ns","key":"uno","value":"data","version":0}`, &jerr)
+	if code != http.StatusPreconditionFailed || jerr.Error.Status != code {
+		t.Fatalf("[%d] %+v", code, jerr)
+	}
+
+	entry = JSONEntry{}
+	code = do("get", `{"namespace":"ns","key":"uno"}`, &entry)
+	if code != http.StatusOK || entry.Value != "data" || entry.Tags[0] != "tag" || *entry.TTL > 100 {
+		t.Fatalf("[%d] %+v", code, entry)
+	}
+
+	var list JSONList
+	code = do("list", `{"namespace":"ns","key":"u*"}`, &list)
+	if code != http.StatusOK || len(list.Keys) != 1 || list.Keys[0] != "uno" {
+		t.Fatalf("[%d] %+v", code, list)
+	}
+
+	var ok JSONOK
+	if code = do("del", `{"namespace":"ns","tags":["tag"]}`, &ok); code != http.StatusOK || !ok.OK {
+		t.Fatalf("[%d] %+v", code, ok)
+	}
+
+	jerr = JSONError{}
+	code = do("get", `{"namespace":"ns","key":"uno"}`, &jerr)
+	if code != http.StatusNotFound || jerr.Error.Message == "" {
+		t.Fatalf("[%d] %+v", code, jerr)
+	}
+
+	jerr = JSONError{}
+	if code = do("get", `{"namespace":`, &jerr); code != http.StatusBadRequest {
+		t.Fatalf("[%d] %+v", code, jerr)
+	}
+
+	jerr = JSONError{}
+	if code = do("nope", `{"namespace":`, &jerr); code != http.StatusNotFound {
+		t.Fatalf("Unknown endpoint: [%d] %+v", code, jerr)
+	}
+}
+
+func TestREST(t *testing.T) {
+	s := newServer()
+	do := func(method, path, body string, h http.Header) *responseWriter {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, err := http.NewRequest(method, "http://localhost/"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		s.req(res, req)
+		return res
+	}
+
+	h := http.Header{HeaderTags: {"tag"}, HeaderNS: {"ignored"}}
+	if res := do("PUT", "ns/foo/keys/a%2Fb", "data", h); res.code != http.StatusCreated {
+		t.Fatalf("[%d] %s", res.code, res.buf.String())
+	}
+	if _, ok := s.c.Get(nsKey("foo", "a/b")); !ok {
+		t.Fatal("Expected key in namespace foo")
+	}
+
+	if res := do("GET", "ns/foo/keys/a%2Fb", "", nil); res.buf.String() != "data" {
+		t.Fatalf("[%d] %s", res.code, res.buf.String())
+	}
+	if res := do("GET", "ns/foo/tags/tag", "", nil); res.buf.String() != "a/b\n" {
+		t.Fatalf("[%d] %s", res.code, res.buf.String())
+	}
+	if res := do("GET", "ns/foo/keys?match=a*", "", nil); res.buf.String() != "a/b\n" {
+		t.Fatalf("[%d] %s", res.code, res.buf.String())
+	}
+	if res := do("GET", "ns/foo/tags", "", nil); res.buf.String() != "tag\n" {
+		t.Fatalf("[%d] %s", res.code, res.buf.String())
+	}
+
+	res := do("POST", "ns/foo/keys/a%2Fb", "", nil)
+	if res.code != http.StatusMethodNotAllowed || res.header.Get("Allow") == "" {
+		t.Fatalf("[%d] %v", res.code, res.header)
+	}
+	if res := do("GET", "ns/foo/bar", "", nil); res.code != http.StatusNotFound {
+		t.Fatalf("[%d] %s", res.code, res.buf.String())
+	}
+
+	do("DELETE", "ns/foo/tags/tag", "", nil)
+	if res := do("GET", "ns/foo/keys/a%2Fb", "", nil); res.code != http.StatusNotFound {
+		t.Fatalf("[%d] %s", res.code, res.buf.String())
+	}
+
+	do("PUT", "ns/foo/keys/a", "data", nil)
+	do("PUT", "ns/bar/keys/a", "data", nil)
+	do("DELETE", "ns/foo", "", nil)
+	if _, ok := s.c.Get(nsKey("foo", "a")); ok {
+		t.Fatal("Expected namespace foo to be purged")
+	}
+	if _, ok := s.c.Get(nsKey("bar", "a")); !ok {
+		t.Fatal("Expected namespace bar to be untouched")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := newServer()
+
+	res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+	req, err := http.NewRequest("POST", "http://localhost/quota", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(HeaderNS, "ns")
+	req.Header.Set(HeaderMaxKeys, "2")
+	req.Header.Set(HeaderQuotaMode, QuotaReject)
+	s.req(res, req)
+	testReq(t, http.StatusOK, res.code, res.buf.Bytes(), nil)
+
+	for _, key := range []string{"uno", "dos"} {
+		code, data, err := makeReq(s, "POST", "set", []byte("data"), "ns", key, "100", nil)
+		testReq(t, http.StatusCreated, code, data, err)
+	}
+
+	code, data, err := makeReq(s, "POST", "set", []byte("data"), "ns", "tres", "100", nil)
+	testReq(t, http.StatusInsufficientStorage, code, data, err)
+
+	// Overwriting an existing key fits.
+	code, data, err = makeReq(s, "POST", "set", []byte("data"), "ns", "uno", "100", nil)
+	testReq(t, http.StatusCreated, code, data, err)
+
+	// Other namespaces are unaffected.
+	code, data, err = makeReq(s, "POST", "set", []byte("data"), "other", "tres", "100", nil)
+	testReq(t, http.StatusCreated, code, data, err)
+}
+
 func TestWildcard(t *testing.T) {
 	test := func(d map[string]int, input string) {
 		s := scanner(input, func(k string) {
@@ -154,6 +474,16 @@ func TestWildcard(t *testing.T) {
 		"input*test",
 	)
 
+	test(
+		map[string]int{
+			"team-a-b-prod": 1,
+			"team---prod":   1,
+			"team--prod":    0,
+			"team-a-prod":   0,
+		},
+		"team-*-*-prod",
+	)
+
 	test(
 		map[string]int{
 			"inputlalatest":    1,
@@ -229,3 +559,507 @@ func TestWildcard(t *testing.T) {
 		"*suffix",
 	)
 }
+
+func TestUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "webis.sock")
+	l, err := ListenUnix(path, 0600, -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected socket mode %v %v", stat.Mode(), err)
+	}
+
+	if _, err := ListenUnix(path, 0600, -1, -1); err == nil {
+		t.Fatal("Listened on a socket in use")
+	}
+
+	s := newServer()
+	// Unix sockets are never served over tls.
+	s.SetTLS(&tls.Config{})
+	go s.Serve(l)
+	defer l.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+
+	req, _ := http.NewRequest("POST", "http://unix/set", strings.NewReader("data"))
+	req.Header.Set(HeaderKey, "key")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if v, _ := s.c.Get(nsKey("", "key")); v != "data" {
+		t.Fatalf("Unexpected value '%s'", v)
+	}
+}
+
+func TestClientNamespaces(t *testing.T) {
+	s := newServer()
+	s.SetClientNamespaces(map[string][]string{
+		"app":          {"app", "shared-*"},
+		"CN=admin,O=x": {AllNamespaces},
+	})
+
+	do := func(subject pkix.Name, path, ns string) int {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		method := "POST"
+		if strings.HasPrefix(path, RESTPrefix) {
+			method = "PUT"
+		}
+		req, _ := http.NewRequest(method, "http://localhost/"+path, strings.NewReader("data"))
+		req.Header.Set(HeaderKey, "key")
+		req.Header.Set(HeaderNS, ns)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}},
+		}
+		s.req(res, req)
+		return res.code
+	}
+
+	app := pkix.Name{CommonName: "app"}
+	admin := pkix.Name{CommonName: "admin", Organization: []string{"x"}}
+	tests := []struct {
+		subject pkix.Name
+		path    string
+		ns      string
+		code    int
+	}{
+		{app, "set", "app", http.StatusCreated},
+		{app, "set", "shared-1", http.StatusCreated},
+		{app, "set", "other", http.StatusForbidden},
+		{app, "set", "", http.StatusForbidden},
+		{app, "ns/other/keys/key", "app", http.StatusForbidden},
+		{app, "ns/app/keys/key", "other", http.StatusCreated},
+		{app, "purge-all", "app", http.StatusForbidden},
+		{pkix.Name{CommonName: "unknown"}, "set", "app", http.StatusForbidden},
+		{admin, "set", "other", http.StatusCreated},
+		{admin, "purge-all", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if code := do(test.subject, test.path, test.ns); code != test.code {
+			t.Errorf("%s %s %s: expected %d got %d", test.subject, test.path, test.ns, test.code, code)
+		}
+	}
+}
+
+func writeCertificate(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "uno")
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cn := func() string {
+		c, _ := cert.GetCertificate(nil)
+		parsed, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Subject.CommonName
+	}
+
+	writeCertificate(t, certFile, keyFile, "dos")
+	if cn() != "uno" {
+		t.Fatal("Certificate changed before reload")
+	}
+
+	if err := cert.Reload(); err != nil || cn() != "dos" {
+		t.Fatalf("Certificate not reloaded %v", err)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err := cert.Reload(); err == nil || cn() != "dos" {
+		t.Fatal("Invalid certificate replaced the current one")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "tokens.json")
+	ioutil.WriteFile(conf, []byte(`{"tokens": [
+		{"token": "reader", "namespaces": ["app-*"], "ops": ["read"]},
+		{"token": "writer", "namespaces": ["app-1"], "ops": ["read", "write", "purge"]},
+		{"token": "root", "namespaces": ["*"], "ops": ["purge-all", "admin"]},
+		{"token": "team", "namespaces": ["team-*-*-prod", "a*b*bc"], "ops": ["read"]},
+		{"token": "abc", "namespaces": ["a*b*c"], "ops": ["read"]}
+	]}`), 0600)
+
+	tokens, err := LoadTokens(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer()
+	s.SetTokens(tokens)
+	do := func(token, method, path, ns string) int {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, _ := http.NewRequest(method, "http://localhost/"+path, strings.NewReader("data"))
+		req.Header.Set(HeaderKey, "key")
+		req.Header.Set(HeaderNS, ns)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.req(res, req)
+		if res.code == http.StatusUnauthorized && res.header.Get("WWW-Authenticate") == "" {
+			t.Error("401 without WWW-Authenticate")
+		}
+		return res.code
+	}
+
+	tests := []struct {
+		token, method, path, ns string
+		code                    int
+	}{
+		{"", "GET", "get", "app-1", http.StatusUnauthorized},
+		{"wrong", "GET", "get", "app-1", http.StatusUnauthorized},
+		{"writer", "POST", "set", "app-1", http.StatusCreated},
+		{"writer", "POST", "set", "app-2", http.StatusForbidden},
+		{"writer", "POST", "del", "app-1", http.StatusForbidden},
+		{"reader", "GET", "get", "app-1", http.StatusOK},
+		{"reader", "GET", "ns/app-1/keys/key", "", http.StatusOK},
+		{"reader", "GET", "get", "other", http.StatusForbidden},
+		{"reader", "POST", "set", "app-1", http.StatusForbidden},
+		{"reader", "PUT", "ns/app-1/keys/key", "", http.StatusForbidden},
+		{"writer", "DELETE", "ns/app-1", "", http.StatusOK},
+		{"writer", "POST", "purge-all", "app-1", http.StatusForbidden},
+		{"root", "GET", "quota", "", http.StatusOK},
+		{"root", "POST", "purge-all", "", http.StatusOK},
+		{"team", "GET", "get", "team-a-b-prod", http.StatusNotFound},
+		{"team", "GET", "get", "team--prod", http.StatusForbidden},
+		{"team", "GET", "get", "team-a-prod", http.StatusForbidden},
+		{"team", "GET", "get", "axbybc", http.StatusNotFound},
+		{"team", "GET", "get", "abc", http.StatusForbidden},
+		{"abc", "GET", "get", "axxbyyc", http.StatusNotFound},
+		{"abc", "GET", "get", "acb", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		if code := do(test.token, test.method, test.path, test.ns); code != test.code {
+			t.Errorf("%+v: got %d", test, code)
+		}
+	}
+
+	if known, ok := s.Permits("reader", OpRead, "app-1", false); !known || !ok {
+		t.Error("Permits denied a permitted op")
+	}
+	if known, ok := s.Permits("reader", OpPurgeAll, "", true); !known || ok {
+		t.Error("Permits allowed a forbidden op")
+	}
+	if known, _ := s.Permits("wrong", OpRead, "app-1", false); known {
+		t.Error("Permits knows an unknown token")
+	}
+
+	s.SetTokens(nil)
+	if known, ok := s.Permits("", OpPurgeAll, "", true); !known || !ok {
+		t.Error("Permits denied with tokens disabled")
+	}
+	if code := do("", "GET", "get", "app-1"); code != http.StatusNotFound {
+		t.Errorf("Tokens still required after disabling: %d", code)
+	}
+
+	ioutil.WriteFile(conf, []byte(`{"tokens": [{"token": "x", "ops": ["bogus"]}]}`), 0600)
+	if _, err := LoadTokens(conf); err == nil {
+		t.Error("Loaded a token with an unknown op")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newServer()
+	s.SetNamespaceMetrics(true)
+	makeReq(s, "POST", "set", []byte("data"), "ns", "key", "", nil)
+	makeReq(s, "GET", "get", nil, "ns", "key", "", nil)
+	makeReq(s, "GET", "get", nil, "ns", "missing", "", nil)
+	makeReq(s, "GET", "ns/ns/keys/key", nil, "", "", "", nil)
+	makeReq(s, "GET", "bogus", nil, "", "", "", nil)
+
+	code, body, err := makeReq(s, "GET", "metrics", nil, "", "", "", nil)
+	testReq(t, http.StatusOK, code, body, err)
+	for _, line := range []string{
+		`webis_requests_total{op="set",code="2xx"} 1`,
+		`webis_requests_total{op="get",code="2xx"} 2`,
+		`webis_requests_total{op="get",code="4xx"} 1`,
+		`webis_requests_total{op="unknown",code="4xx"} 1`,
+		`webis_request_duration_seconds_count{op="get"} 3`,
+		`webis_request_duration_seconds_bucket{op="get",le="+Inf"} 3`,
+		`webis_cache_hits_total 2`,
+		`webis_cache_misses_total 1`,
+		`webis_keys 1`,
+		`webis_removed_total{reason="tag"} 0`,
+		`webis_namespace_keys{ns="ns"} 1`,
+	} {
+		if !bytes.Contains(body, []byte(line+"\n")) {
+			t.Errorf("Missing %s in:\n%s", line, body)
+		}
+	}
+
+	s.SetTokens([]Token{{Token: "reader", Namespaces: []string{"*"}, Ops: []Op{OpRead}}})
+	code, _, _ = makeReq(s, "GET", "metrics", nil, "", "", "", nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("Metrics without token: %d", code)
+	}
+}
+
+func TestReady(t *testing.T) {
+	s := newServer()
+	s.SetReady(false)
+	for path, expect := range map[string]int{
+		"healthz": http.StatusOK,
+		"readyz":  http.StatusServiceUnavailable,
+		"get":     http.StatusServiceUnavailable,
+	} {
+		code, body, err := makeReq(s, "GET", path, nil, "", "key", "", nil)
+		testReq(t, expect, code, body, err)
+	}
+
+	s.SetReady(true)
+	code, body, err := makeReq(s, "GET", "readyz", nil, "", "", "", nil)
+	testReq(t, http.StatusOK, code, body, err)
+	code, body, err = makeReq(s, "GET", "get", nil, "", "key", "", nil)
+	testReq(t, http.StatusNotFound, code, body, err)
+}
+
+func TestEvents(t *testing.T) {
+	s := newServer()
+	hs := httptest.NewServer(s.s.Handler)
+	defer hs.Close()
+
+	res, err := http.Get(hs.URL + "/events?ns=ns&tag=t*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type %s", ct)
+	}
+
+	makeReq(s, "POST", "set", []byte("data"), "other", "key", "", []string{"tag"})
+	makeReq(s, "POST", "set", []byte("data"), "ns", "untagged", "", nil)
+	makeReq(s, "POST", "set", []byte("data"), "ns", "key", "", []string{"tag"})
+	makeReq(s, "POST", "del", nil, "ns", "", "", []string{"tag"})
+
+	r := bufio.NewReader(res.Body)
+	for _, expect := range []string{
+		"event: set",
+		`data: {"namespace":"ns","key":"key","tags":["tag"],"reason":"set"}`,
+		"",
+		"event: tag",
+		`data: {"namespace":"ns","key":"key","tags":["tag"],"reason":"tag"}`,
+	} {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l = strings.TrimSuffix(l, "\n"); l != expect {
+			t.Fatalf("Expected '%s' got '%s'", expect, l)
+		}
+	}
+
+	s.SetTokens([]Token{{Token: "t", Namespaces: []string{"ns"}, Ops: []Op{OpRead}}})
+	req, _ := http.NewRequest("GET", hs.URL+"/events?ns=*", nil)
+	req.Header.Set("Authorization", "Bearer t")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("Subscribed to all namespaces: %d", res.StatusCode)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	s := newServer()
+	do := func(method, path string, h http.Header) *responseWriter {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, _ := http.NewRequest(method, "http://localhost/"+path, strings.NewReader(`{}`))
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		s.req(res, req)
+		return res
+	}
+
+	do("POST", "set", http.Header{
+		HeaderKey:          {"key"},
+		"Content-Type":     {"application/json"},
+		"Content-Encoding": {"identity"},
+		"X-Meta-Owner":     {"me"},
+		"X-Other":          {"dropped"},
+	})
+	do("PUT", "ns/ns/keys/rest", http.Header{"Content-Type": {"image/png"}})
+
+	res := do("GET", "get", http.Header{HeaderKey: {"key"}})
+	if res.code != http.StatusOK ||
+		res.header.Get("Content-Type") != "application/json" ||
+		res.header.Get("Content-Encoding") != "identity" ||
+		res.header.Get("X-Meta-Owner") != "me" ||
+		res.header.Get("X-Other") != "" {
+		t.Fatalf("Unexpected response %d %v", res.code, res.header)
+	}
+
+	res = do("GET", "ns/ns/keys/rest", nil)
+	if res.header.Get("Content-Type") != "image/png" {
+		t.Fatalf("Unexpected headers %v", res.header)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	s := newServer()
+	makeReq(s, "POST", "set", []byte("data"), "", "key", "", nil)
+	code, body, err := makeReq(s, "GET", "get", nil, "", "key", "", nil)
+	testReq(t, http.StatusOK, code, body, err)
+
+	get := func(h http.Header) *responseWriter {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, _ := http.NewRequest("GET", "http://localhost/get", nil)
+		req.Header = h
+		req.Header.Set(HeaderKey, "key")
+		s.req(res, req)
+		return res
+	}
+
+	res := get(http.Header{})
+	tag, modified := res.header.Get("ETag"), res.header.Get("Last-Modified")
+	if tag == "" || modified == "" {
+		t.Fatalf("Missing validators %v", res.header)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		h    http.Header
+		code int
+	}{
+		{http.Header{"If-None-Match": {tag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"other", W/` + tag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+		{http.Header{"If-Modified-Since": {modified}}, http.StatusNotModified},
+		{http.Header{"If-Modified-Since": {past}}, http.StatusOK},
+		// If-None-Match takes precedence.
+		{http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {modified}}, http.StatusOK},
+	}
+	for _, test := range tests {
+		res := get(test.h)
+		if res.code != test.code {
+			t.Errorf("%v: expected %d got %d", test.h, test.code, res.code)
+		}
+		if res.code == http.StatusNotModified && res.buf.Len() != 0 {
+			t.Errorf("%v: 304 with a body", test.h)
+		}
+	}
+
+	makeReq(s, "POST", "set", []byte("new"), "", "key", "", nil)
+	if res := get(http.Header{"If-None-Match": {tag}}); res.code != http.StatusOK {
+		t.Fatalf("Stale etag matched: %d", res.code)
+	}
+	if item, _ := s.c.GetItem(nsKey("", "key")); item.Meta != nil {
+		t.Fatalf("Validators stored as meta: %v", item.Meta)
+	}
+
+	// Writes by other protocols carry a modified time as well.
+	s.c.Set(nsKey("", "key"), nil, "other", time.Now().Add(time.Hour))
+	if res := get(http.Header{}); res.header.Get("Last-Modified") == "" {
+		t.Fatalf("Missing Last-Modified %v", res.header)
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := newServer()
+	makeReq(s, "POST", "set", []byte("0123456789"), "", "key", "", nil)
+	get := func(h http.Header) *responseWriter {
+		res := &responseWriter{make(http.Header), bytes.NewBuffer(nil), 0}
+		req, _ := http.NewRequest("GET", "http://localhost/get", nil)
+		req.Header = h
+		req.Header.Set(HeaderKey, "key")
+		s.req(res, req)
+		return res
+	}
+
+	res := get(http.Header{"Range": {"bytes=2-4"}})
+	if res.code != http.StatusPartialContent || res.buf.String() != "234" ||
+		res.header.Get("Content-Range") != "bytes 2-4/10" {
+		t.Fatalf("Unexpected response %d %v '%s'", res.code, res.header, res.buf)
+	}
+
+	tag := res.header.Get("ETag")
+	res = get(http.Header{"Range": {"bytes=0-0,-2"}})
+	if res.code != http.StatusPartialContent ||
+		!strings.HasPrefix(res.header.Get("Content-Type"), "multipart/byteranges") ||
+		!strings.Contains(res.buf.String(), "89") {
+		t.Fatalf("Unexpected multipart response %d %v", res.code, res.header)
+	}
+
+	res = get(http.Header{"Range": {"bytes=20-"}})
+	if res.code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Expected 416, got %d", res.code)
+	}
+
+	// A stale If-Range validator gets the full value.
+	res = get(http.Header{"Range": {"bytes=2-4"}, "If-Range": {tag}})
+	if res.code != http.StatusPartialContent {
+		t.Fatalf("Matching If-Range: %d", res.code)
+	}
+	makeReq(s, "POST", "set", []byte("abcdefghij"), "", "key", "", nil)
+	res = get(http.Header{"Range": {"bytes=2-4"}, "If-Range": {tag}})
+	if res.code != http.StatusOK || res.buf.String() != "abcdefghij" {
+		t.Fatalf("Stale If-Range: %d '%s'", res.code, res.buf)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// AllNamespaces as an allowed namespace pattern also allows operations
+// that span all namespaces, such as /purge-all.
+const AllNamespaces = "*"
+
+// Certificate is a tls certificate that can be reloaded from disk
+// without restarting the server.
+type Certificate struct {
+	sem      sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+// LoadCertificate loads a PEM encoded certificate and key.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	return c, c.Reload()
+}
+
+// Reload rereads the certificate and key, the current certificate is kept
+// if that fails.
+func (c *Certificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.sem.Lock()
+	c.cert = &cert
+	c.sem.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.sem.RLock()
+	cert := c.cert
+	c.sem.RUnlock()
+	return cert, nil
+}
+
+// LoadCertPool reads a PEM encoded CA bundle.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, errors.New("No certificates found in " + file)
+	}
+
+	return pool, nil
+}
+
+// TLSConfig creates a server tls configuration using cert, and if
+// clientCAs is not nil, requires clients to present a certificate
+// signed by one of them.
+func TLSConfig(cert *Certificate, clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+	}
+
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg
+}
+
+// SetTLS makes Start and Serve use tls, it should be called before either.
+func (s *Server) SetTLS(cfg *tls.Config) {
+	s.s.TLSConfig = cfg
+}
+
+// SetClientNamespaces restricts clients authenticated by a certificate
+// to the namespaces matching the *-wildcard patterns of their subject,
+// either its common name or the full distinguished name.
+// Clients without an entry are denied, a nil map allows all clients.
+func (s *Server) SetClientNamespaces(m map[string][]string) {
+	s.clientNS = m
+}
+
+// allowed reports whether the client certificate of r permits access to
+// namespace ns, or to all namespaces if all is true.
+func (s *Server) allowed(r *http.Request, ns string, all bool) bool {
+	if s.clientNS == nil || r.TLS == nil {
+		return true
+	}
+
+	if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	patterns, ok := s.clientNS[subject.String()]
+	if !ok {
+		patterns = s.clientNS[subject.CommonName]
+	}
+
+	return matchNamespace(patterns, ns, all)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// ListenUnix listens on a unix socket at path with the given file mode and
+// ownership, a uid or gid of -1 is left unchanged. A socket left behind by
+// a previous process is replaced, one that is still in use is not.
+func ListenUnix(path string, mode os.FileMode, uid, gid int) (net.Listener, error) {
+	if stat, err := os.Lstat(path); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}